@@ -1,18 +1,27 @@
 package config
 
 import (
+	"common/pkg/retry"
+	"github.com/fsnotify/fsnotify"
 	"github.com/joho/godotenv"
 	"github.com/spf13/viper"
 	"log"
 	"os"
+	"path/filepath"
 	"time"
 )
 
 type (
 	Config struct {
-		HTTP   HTTP
-		Rabbit UrlRabbit
-		UpBit  UpBit
+		HTTP      HTTP
+		Rabbit    UrlRabbit
+		WebSocket WebSocket
+		UpBit     UpBit
+		Bithumb   Bithumb
+		Binance   Binance
+		Streams   []Stream `mapstructure:"streams"`
+		Mongo     Mongo
+		Shutdown  Shutdown
 	}
 
 	HTTP struct {
@@ -23,10 +32,49 @@ type (
 		MaxHeaderMegabytes int           `mapstructure:"maxHeaderMegabytes"`
 	}
 
+	WebSocket struct {
+		MarketResync time.Duration `mapstructure:"marketResync"`
+		ShardSize    int           `mapstructure:"shardSize"`
+		PingInterval time.Duration `mapstructure:"pingInterval"`
+		PongTimeout  time.Duration `mapstructure:"pongTimeout"`
+		IdleTimeout  time.Duration `mapstructure:"idleTimeout"`
+		// StateFile keeps the streams started through the control API when MongoDB is not configured.
+		StateFile  string       `mapstructure:"stateFile"`
+		Reconnect  retry.Policy `mapstructure:"reconnect"`
+		Supervisor struct {
+			CrashLoopWindow   time.Duration `mapstructure:"crashLoopWindow"`
+			CrashLoopRestarts int           `mapstructure:"crashLoopRestarts"`
+			Restart           retry.Policy  `mapstructure:"restart"`
+		} `mapstructure:"supervisor"`
+		// Pipeline sits between reading a stream and publishing it.
+		Pipeline struct {
+			Workers    int    `mapstructure:"workers"`
+			BufferSize int    `mapstructure:"bufferSize"`
+			Overflow   string `mapstructure:"overflow"`
+		} `mapstructure:"pipeline"`
+	}
+
 	UpBit struct {
-		AccessKey string
-		SecretKey string
-		WsURL     string
+		AccessKey      string
+		SecretKey      string
+		WsURL          string
+		PrivateWsURL   string
+		Account        string
+		RestURL        string        `mapstructure:"restURL"`
+		Quotes         []string      `mapstructure:"quotes"`
+		MarketRefresh  time.Duration `mapstructure:"marketRefresh"`
+		OrderbookUnits int           `mapstructure:"orderbookUnits"`
+	}
+
+	Bithumb struct {
+		WsURL     string   `mapstructure:"wsURL"`
+		Symbols   []string `mapstructure:"symbols"`
+		TickTypes []string `mapstructure:"tickTypes"`
+	}
+
+	Binance struct {
+		WsURL   string   `mapstructure:"wsURL"`
+		Symbols []string `mapstructure:"symbols"`
 	}
 
 	UrlRabbit struct {
@@ -35,21 +83,191 @@ type (
 		Host         string
 		Port         string
 		ErlangCookie string
+		Reconnect    retry.Policy `mapstructure:"reconnect"`
+		// BufferSize caps the messages kept while RabbitMQ is unreachable.
+		BufferSize int `mapstructure:"bufferSize"`
+		// Confirm enables publisher confirms and mandatory publishing.
+		Confirm bool `mapstructure:"confirm"`
+		// NackRetries caps how often a message nacked by the broker is published again.
+		NackRetries int `mapstructure:"nackRetries"`
+		// Spool keeps the messages the buffer cannot hold on disk.
+		Spool Spool `mapstructure:"spool"`
+		// Exchange is the topic exchange market data is published to.
+		Exchange Exchange `mapstructure:"exchange"`
+		Topology Topology `mapstructure:"topology"`
+		// Stream keeps the trades in a stream queue for replay, it is disabled without Name.
+		Stream StreamQueue `mapstructure:"stream"`
+	}
+
+	StreamQueue struct {
+		Name string `mapstructure:"name"`
+		// Keys are the routing keys fed into the stream, *.trade.# by default.
+		Keys           []string      `mapstructure:"keys"`
+		MaxAge         time.Duration `mapstructure:"maxAge"`
+		MaxLengthBytes int64         `mapstructure:"maxLengthBytes"`
+		MaxSegmentSize int64         `mapstructure:"maxSegmentSize"`
+	}
+
+	// Topology configures the queues the producer declares.
+	Topology struct {
+		// Defaults apply to every queue, Queues override them per queue.
+		Defaults QueueSpec   `mapstructure:"defaults"`
+		Queues   []QueueSpec `mapstructure:"queues"`
+		// OnDrift is warn or fail, for queues that exist with other settings.
+		OnDrift string `mapstructure:"onDrift"`
+	}
+
+	// QueueSpec holds the declaration settings of a queue, unset fields are inherited.
+	QueueSpec struct {
+		Name       string `mapstructure:"name"`
+		Durable    *bool  `mapstructure:"durable"`
+		AutoDelete *bool  `mapstructure:"autoDelete"`
+		// Type is classic, quorum or stream.
+		Type           string        `mapstructure:"type"`
+		MessageTTL     time.Duration `mapstructure:"messageTTL"`
+		MaxLength      int64         `mapstructure:"maxLength"`
+		MaxLengthBytes int64         `mapstructure:"maxLengthBytes"`
+		// Overflow is drop-head, reject-publish or reject-publish-dlx.
+		Overflow             string `mapstructure:"overflow"`
+		DeadLetterExchange   string `mapstructure:"deadLetterExchange"`
+		DeadLetterRoutingKey string `mapstructure:"deadLetterRoutingKey"`
+		// MaxAge and MaxSegmentSize apply to stream queues only.
+		MaxAge         time.Duration `mapstructure:"maxAge"`
+		MaxSegmentSize int64         `mapstructure:"maxSegmentSize"`
+	}
+
+	Exchange struct {
+		Name string `mapstructure:"name"`
+		// LegacyQueues binds the per data type queues, such as trade_queue, to the exchange.
+		LegacyQueues bool      `mapstructure:"legacyQueues"`
+		Bindings     []Binding `mapstructure:"bindings"`
+	}
+
+	// Binding declares a durable queue receiving the routing keys that match one of Keys.
+	Binding struct {
+		Queue string   `mapstructure:"queue"`
+		Keys  []string `mapstructure:"keys"`
+	}
+
+	// Spool is the write-ahead spool of the RabbitMQ producer, it is disabled without Dir.
+	Spool struct {
+		Dir string `mapstructure:"dir"`
+		// SegmentSize is the size of a segment file in bytes.
+		SegmentSize int64 `mapstructure:"segmentSize"`
+		// MaxSize drops the oldest segments once the spool grows beyond it, in bytes.
+		MaxSize int64         `mapstructure:"maxSize"`
+		MaxAge  time.Duration `mapstructure:"maxAge"`
+		// SyncInterval bounds how long appended messages stay in the page cache before they are flushed to disk.
+		SyncInterval time.Duration `mapstructure:"syncInterval"`
+	}
+
+	Shutdown struct {
+		// Timeout bounds the whole shutdown, from the HTTP server to the RabbitMQ connection.
+		Timeout time.Duration `mapstructure:"timeout"`
+	}
+
+	Mongo struct {
+		URI      string
+		Database string        `mapstructure:"database"`
+		Timeout  time.Duration `mapstructure:"timeout"`
+	}
+
+	// Stream declares a stream that is started at boot and kept running.
+	Stream struct {
+		Platform string `mapstructure:"platform"`
+		// DataType takes several data types separated by commas, like the control API.
+		DataType string `mapstructure:"dataType"`
+		// Markets restricts the stream to these markets, empty streams every listed market.
+		Markets []string `mapstructure:"markets"`
+		// Sinks are the queues messages are published to, empty uses the market data exchange.
+		Sinks []string `mapstructure:"sinks"`
 	}
 )
 
 //var CFG *Config
 
+// reloadDelay is how long Watch waits after the last change before reloading.
+const reloadDelay = 100 * time.Millisecond
+
 // InitConfig initializes the configuration for the application.
 func InitConfig() (*Config, error) {
 	if err := godotenv.Load("../.env"); err != nil {
 		log.Printf("No .env file found or error loading .env file: %v", err)
 	}
 
-	if err := parseConfigFile("../", os.Getenv("APP_ENV")); err != nil {
+	if _, err := parseConfigFile("../", os.Getenv("APP_ENV")); err != nil {
 		return nil, err
 	}
+	return load()
+}
+
+// Watch calls onChange with the reloaded configuration whenever config.yaml or
+// the override file of APP_ENV changes. A change to either reads both again,
+// so that the overrides keep applying on top of the base file.
+func Watch(onChange func(*Config)) {
+	files, err := parseConfigFile("../", os.Getenv("APP_ENV"))
+	if err != nil {
+		log.Printf("Failed to watch config: %v", err)
+		return
+	}
+	watched := make(map[string]bool, len(files))
+	for _, file := range files {
+		watched[filepath.Clean(file)] = true
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Failed to watch config: %v", err)
+		return
+	}
+	// Editors and config maps replace files rather than write them, so their
+	// folders are watched instead.
+	for _, file := range files {
+		if err := watcher.Add(filepath.Dir(file)); err != nil {
+			log.Printf("Failed to watch config: %v", err)
+			watcher.Close()
+			return
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		// A save truncates the file before writing it, the reload waits for
+		// the events to settle so that it does not read a partial file.
+		reload := time.NewTimer(0)
+		<-reload.C
+		for {
+			select {
+			case e, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if watched[filepath.Clean(e.Name)] && (e.Has(fsnotify.Write) || e.Has(fsnotify.Create)) {
+					log.Printf("Config file %s changed, reloading", e.Name)
+					reload.Reset(reloadDelay)
+				}
+			case <-reload.C:
+				if _, err := parseConfigFile("../", os.Getenv("APP_ENV")); err != nil {
+					log.Printf("Failed to reload config: %v", err)
+					continue
+				}
+				cfg, err := load()
+				if err != nil {
+					log.Printf("Failed to reload config: %v", err)
+					continue
+				}
+				onChange(cfg)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Config watcher failed: %v", err)
+			}
+		}
+	}()
+}
 
+func load() (*Config, error) {
 	var cfg Config
 	if err := viper.Unmarshal(&cfg); err != nil {
 		return nil, err
@@ -69,18 +287,40 @@ func setFromEnv(cfg *Config) {
 	cfg.UpBit.WsURL = os.Getenv("UPBIT_URL")
 	cfg.UpBit.AccessKey = os.Getenv("UPBIT_ACCESS")
 	cfg.UpBit.SecretKey = os.Getenv("UPBIT_SECRET")
+	cfg.UpBit.PrivateWsURL = os.Getenv("UPBIT_PRIVATE_URL")
+	cfg.UpBit.Account = os.Getenv("UPBIT_ACCOUNT")
+	if url := os.Getenv("UPBIT_REST_URL"); url != "" {
+		cfg.UpBit.RestURL = url
+	}
+
+	if url := os.Getenv("BITHUMB_URL"); url != "" {
+		cfg.Bithumb.WsURL = url
+	}
+	if url := os.Getenv("BINANCE_URL"); url != "" {
+		cfg.Binance.WsURL = url
+	}
+
+	cfg.Mongo.URI = os.Getenv("MONGO_URI")
 }
 
-func parseConfigFile(folder, env string) error {
+// parseConfigFile reads config.yaml and merges the override file of env on top
+// of it. It returns the files read.
+func parseConfigFile(folder, env string) ([]string, error) {
 	viper.AddConfigPath(folder)
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
 
 	if err := viper.ReadInConfig(); err != nil {
-		return err
+		return nil, err
+	}
+	files := []string{viper.ConfigFileUsed()}
+	if env == "" {
+		return files, nil
 	}
 
 	viper.SetConfigName(env)
-
-	return viper.MergeInConfig()
+	if err := viper.MergeInConfig(); err != nil {
+		return nil, err
+	}
+	return append(files, viper.ConfigFileUsed()), nil
 }
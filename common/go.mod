@@ -2,4 +2,7 @@ module common
 
 go 1.21.4
 
-require github.com/streadway/amqp v1.1.0
+require (
+	github.com/streadway/amqp v1.1.0
+	go.mongodb.org/mongo-driver v1.13.1
+)
@@ -1 +1,59 @@
 package mongo
+
+import (
+	"common/config"
+	"common/pkg/log"
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+const defaultTimeout = 10 * time.Second
+
+type Client struct {
+	client   *mongo.Client
+	database *mongo.Database
+}
+
+// Connect connects to the configured MongoDB and checks that it answers.
+func Connect(ctx context.Context, cfg *config.Config) (*Client, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	if cfg.Mongo.URI == "" {
+		return nil, fmt.Errorf("mongo uri is not configured")
+	}
+
+	timeout := cfg.Mongo.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.Mongo.URI).SetTimeout(timeout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MongoDB: %v", err)
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		_ = client.Disconnect(context.Background())
+		return nil, fmt.Errorf("failed to ping MongoDB: %v", err)
+	}
+	log.Logger.Info("Connected to MongoDB!")
+
+	return &Client{
+		client:   client,
+		database: client.Database(cfg.Mongo.Database),
+	}, nil
+}
+
+// Collection returns a collection of the configured database.
+func (c *Client) Collection(name string) *mongo.Collection {
+	return c.database.Collection(name)
+}
+
+func (c *Client) Close(ctx context.Context) error {
+	return c.client.Disconnect(ctx)
+}
@@ -0,0 +1,242 @@
+package rabbitmq
+
+import (
+	"common/pkg/log"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/streadway/amqp"
+	"sort"
+	"sync"
+)
+
+const confirmBuffer = 1024
+
+var (
+	// ErrNacked is returned when the broker refused to take a message.
+	ErrNacked = errors.New("message was nacked by the broker")
+	// ErrUnroutable is returned when a mandatory message matched no queue.
+	ErrUnroutable = errors.New("message was returned as unroutable")
+)
+
+// Confirmation settles once the broker confirmed a message. Without confirm
+// mode it settles as soon as the message was written to the channel. A message
+// written to the spool settles once appended to it, before the broker has it:
+// the spool outlives the process, so its messages may be published by a later
+// run, and it is there to keep them out of memory, confirmations included.
+type Confirmation struct {
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func newConfirmation() *Confirmation {
+	return &Confirmation{done: make(chan struct{})}
+}
+
+func (c *Confirmation) resolve(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+	})
+}
+
+// Done is closed once the message is settled.
+func (c *Confirmation) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the message was not confirmed, it is nil until Done is closed.
+func (c *Confirmation) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the message is settled or ctx is done.
+func (c *Confirmation) Wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type unconfirmed struct {
+	msg      message
+	returned bool
+}
+
+// confirms tracks the messages published on the current channel until the
+// broker acks them. Delivery tags restart with every channel, gen tells the
+// listeners of earlier channels apart.
+type confirms struct {
+	// nacked takes over the messages the broker refused, they are settled with
+	// ErrNacked without it.
+	nacked func(message)
+
+	mu      sync.Mutex
+	gen     int
+	nextTag uint64
+	pending map[uint64]*unconfirmed
+	ids     map[string]uint64
+}
+
+// track registers a message about to be published, the returned tag is its
+// delivery tag on the current channel.
+func (c *confirms) track(msg message) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nextTag++
+	c.pending[c.nextTag] = &unconfirmed{msg: msg}
+	c.ids[msg.id] = c.nextTag
+	return c.nextTag
+}
+
+// untrack forgets a message that could not be published.
+func (c *confirms) untrack(tag uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if u, ok := c.pending[tag]; ok {
+		delete(c.ids, u.msg.id)
+		delete(c.pending, tag)
+	}
+	if tag == c.nextTag {
+		c.nextTag--
+	}
+}
+
+// reset starts a new channel generation and returns the messages that were
+// not confirmed on the previous channel, in publishing order.
+func (c *confirms) reset() (int, []message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tags := make([]uint64, 0, len(c.pending))
+	for tag := range c.pending {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	msgs := make([]message, 0, len(tags))
+	for _, tag := range tags {
+		msgs = append(msgs, c.pending[tag].msg)
+	}
+
+	c.gen++
+	c.nextTag = 0
+	c.pending = make(map[uint64]*unconfirmed)
+	c.ids = make(map[string]uint64)
+	return c.gen, msgs
+}
+
+func (c *confirms) outstanding() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+// drop settles every outstanding message with err.
+func (c *confirms) drop(err error) {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make(map[uint64]*unconfirmed)
+	c.ids = make(map[string]uint64)
+	c.mu.Unlock()
+
+	for _, u := range pending {
+		u.msg.confirm.resolve(err)
+	}
+}
+
+func (c *confirms) returned(gen int, ret amqp.Return) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+	if tag, ok := c.ids[ret.MessageId]; ok {
+		c.pending[tag].returned = true
+	}
+	log.Logger.Error(fmt.Sprintf("Message to %s was returned: %d %s", ret.RoutingKey, ret.ReplyCode, ret.ReplyText))
+}
+
+func (c *confirms) confirmed(gen int, conf amqp.Confirmation) {
+	c.mu.Lock()
+	if gen != c.gen {
+		c.mu.Unlock()
+		return
+	}
+	u, ok := c.pending[conf.DeliveryTag]
+	if ok {
+		delete(c.pending, conf.DeliveryTag)
+		delete(c.ids, u.msg.id)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	switch {
+	case !conf.Ack && c.nacked != nil:
+		c.nacked(u.msg)
+	case !conf.Ack:
+		u.msg.confirm.resolve(ErrNacked)
+	case u.returned:
+		u.msg.confirm.resolve(ErrUnroutable)
+	default:
+		u.msg.confirm.resolve(nil)
+	}
+}
+
+// listen puts a channel in confirm mode and settles its messages as the broker
+// acks, nacks or returns them.
+func (c *confirms) listen(ch *amqp.Channel, gen int) error {
+	if err := ch.Confirm(false); err != nil {
+		return fmt.Errorf("failed to put the channel in confirm mode: %v", err)
+	}
+	acks := ch.NotifyPublish(make(chan amqp.Confirmation, confirmBuffer))
+	returns := ch.NotifyReturn(make(chan amqp.Return, confirmBuffer))
+
+	go func() {
+		for {
+			select {
+			case ret, ok := <-returns:
+				if !ok {
+					returns = nil
+					continue
+				}
+				c.returned(gen, ret)
+			case conf, ok := <-acks:
+				if !ok {
+					return
+				}
+				// The broker sends basic.return before the ack of the same
+				// message, take the returns in first so the ack sees them.
+				c.drainReturns(gen, returns)
+				c.confirmed(gen, conf)
+			}
+		}
+	}()
+	return nil
+}
+
+func (c *confirms) drainReturns(gen int, returns <-chan amqp.Return) {
+	for {
+		select {
+		case ret, ok := <-returns:
+			if !ok {
+				return
+			}
+			c.returned(gen, ret)
+		default:
+			return
+		}
+	}
+}
@@ -3,6 +3,8 @@ package rabbitmq
 import (
 	"common/config"
 	"common/pkg/log"
+	"common/pkg/retry"
+	"context"
 	"fmt"
 	"github.com/streadway/amqp"
 	"time"
@@ -12,6 +14,9 @@ type Connection struct {
 	instance *amqp.Connection
 	cfg      *config.Config
 	//once     sync.Once
+
+	// OnRetry is called with the attempt number and delay before every retry.
+	OnRetry func(attempt int, delay time.Duration)
 }
 
 func NewConnectWithRetries(cfg *config.Config) *Connection {
@@ -19,6 +24,12 @@ func NewConnectWithRetries(cfg *config.Config) *Connection {
 }
 
 func (c *Connection) ConnectWithRetries(cfg *config.Config, retries int) (*amqp.Connection, error) {
+	return c.ConnectContext(context.Background(), cfg, retries)
+}
+
+// ConnectContext dials RabbitMQ like ConnectWithRetries and stops retrying once
+// ctx is done.
+func (c *Connection) ConnectContext(ctx context.Context, cfg *config.Config, retries int) (*amqp.Connection, error) {
 	if cfg == nil {
 		return nil, fmt.Errorf("config is nil")
 	}
@@ -30,17 +41,28 @@ func (c *Connection) ConnectWithRetries(cfg *config.Config, retries int) (*amqp.
 		cfg.Rabbit.Port,
 	)
 
-	var conn *amqp.Connection
-	var err error
-	for i := 1; i <= retries; i++ {
-		conn, err = amqp.Dial(URL)
+	// retries caps the attempts unless the configured policy sets its own limit
+	policy := cfg.Rabbit.Reconnect
+	if policy.MaxAttempts == 0 {
+		policy.MaxAttempts = retries
+	}
+	backoff := retry.NewBackoff(policy)
+	backoff.OnRetry = func(attempt int, delay time.Duration) {
+		log.Logger.Info(fmt.Sprintf("Failed to connect to RabbitMQ (attempt %d). Retrying in %s...", attempt, delay.Round(time.Millisecond)))
+		if c.OnRetry != nil {
+			c.OnRetry(attempt, delay)
+		}
+	}
+
+	for {
+		conn, err := amqp.Dial(URL)
 		if err == nil {
 			log.Logger.Info("Connected to RabbitMQ!")
 			return conn, nil
 		}
 
-		log.Logger.Info(fmt.Sprintf("Failed to connect to RabbitMQ (attempt %d/%d). Retrying in 5 seconds...\n", i, retries))
-		time.Sleep(5 * time.Second)
+		if waitErr := backoff.Wait(ctx); waitErr != nil {
+			return nil, fmt.Errorf("unable to establish connection after %d retries: %v", backoff.Attempt()-1, err)
+		}
 	}
-	return nil, fmt.Errorf("unable to establish connection after %d retries: %v", retries, err)
 }
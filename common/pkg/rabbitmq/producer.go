@@ -2,15 +2,91 @@ package rabbitmq
 
 import (
 	"common/config"
+	"common/pkg/spool"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/streadway/amqp"
 	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	defaultBufferSize  = 10000
+	defaultNackRetries = 5
+	// nackDelay spaces out the republishes of a nacked message, growing with every attempt.
+	nackDelay = 100 * time.Millisecond
+	// drainInterval is how often Shutdown checks whether the buffer was sent.
+	drainInterval = 100 * time.Millisecond
+)
+
+var (
+	// ErrProducerClosed is returned by publishes after Shutdown.
+	ErrProducerClosed = errors.New("producer is closed")
+	// ErrBufferFull is returned when a message is dropped because the broker is
+	// unreachable and the outage buffer is full.
+	ErrBufferFull = errors.New("producer buffer is full")
+)
+
+// queues are declared on every (re)connect, together with the queues added
+// through DeclareQueue and the exchange topology.
+var queues = []string{
+	"market_events_queue",
+}
+
+type message struct {
+	id string
+	// exchange is empty for the default exchange, where key names the queue.
+	exchange string
+	key      string
+	body     string
+	headers  amqp.Table
+	confirm  *Confirmation
+	// attempts counts the republishes after a nack.
+	attempts int
+}
+
+// Producer publishes to RabbitMQ. When the channel or connection is lost it
+// reconnects in the background, messages published meanwhile are kept in a
+// bounded buffer and sent once the connection is back. With a spool configured,
+// messages beyond the buffer are written to disk and replayed in order.
 type Producer struct {
-	conn *amqp.Connection
-	ch   *amqp.Channel
-	cfg  *config.Config
+	cfg        *config.Config
+	connection RabbitConnection
+
+	// mu serializes publishes with recovery and Shutdown, which thereby waits
+	// for the publish in flight.
+	mu       sync.Mutex
+	up       bool
+	draining bool
+	buffer   []message
+	extra    []string
+	dropped  atomic.Uint64
+	// confirms is nil unless confirm mode is enabled.
+	confirms *confirms
+	// requeued counts the nacked messages waiting to be published again.
+	requeued atomic.Int64
+	lastID   atomic.Uint64
+	// spool is nil unless configured. While spooling is set the spool holds
+	// messages older than any new one, which therefore go there as well.
+	spool     *spool.Spool
+	spooling  bool
+	replaying bool
+	// drifted maps the queues that differ from their configuration to the broker's complaint.
+	drifted map[string]string
+
+	// connMu guards conn and ch so that Close does not wait for mu.
+	connMu sync.Mutex
+	conn   *amqp.Connection
+	ch     *amqp.Channel
+
+	closed atomic.Bool
+	// stop interrupts the recovery once the producer is closed.
+	stop   context.Context
+	cancel context.CancelFunc
 }
 
 func NewProducer(cfg *config.Config, connection RabbitConnection) (*Producer, error) {
@@ -26,53 +102,335 @@ func NewProducer(cfg *config.Config, connection RabbitConnection) (*Producer, er
 		return nil, fmt.Errorf("producer failed to open a channel: %s", err)
 	}
 
-	_, err = ch.QueueDeclare(
-		"trade_queue",
-		false,
-		false,
-		false,
-		false,
-		nil)
-	if err != nil {
-		return nil, fmt.Errorf("producer failed to declare Trade Queue: %s", err)
+	p := &Producer{
+		cfg:        cfg,
+		connection: connection,
+		up:         true,
+		conn:       conn,
+		ch:         ch,
 	}
-
-	_, err = ch.QueueDeclare(
-		"ticker_queue",
-		false,
-		false,
-		false,
-		false,
-		nil)
-	if err != nil {
-		return nil, fmt.Errorf("producer failed to declare Ticker Queue: %s", err)
+	if err := p.declareTopology(conn, ch); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if cfg.Rabbit.Confirm {
+		p.confirms = &confirms{nacked: p.nacked}
+		gen, _ := p.confirms.reset()
+		if err := p.confirms.listen(ch, gen); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if cfg.Rabbit.Spool.Dir != "" {
+		p.spool, err = spool.Open(spool.Options{
+			Dir:          cfg.Rabbit.Spool.Dir,
+			SegmentSize:  cfg.Rabbit.Spool.SegmentSize,
+			MaxSize:      cfg.Rabbit.Spool.MaxSize,
+			MaxAge:       cfg.Rabbit.Spool.MaxAge,
+			SyncInterval: cfg.Rabbit.Spool.SyncInterval,
+		})
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("producer failed to open the spool: %v", err)
+		}
+		// Messages spooled before a restart go out first.
+		p.spooling = p.spool.Len() > 0
 	}
+	p.stop, p.cancel = context.WithCancel(context.Background())
+	go p.watch(conn, ch)
+	p.mu.Lock()
+	p.startReplay()
+	p.mu.Unlock()
+	return p, nil
+}
 
-	return &Producer{
-		conn: conn,
-		ch:   ch,
-	}, nil
+// DeclareQueue declares an additional queue with its configured topology. It is
+// declared again after every reconnect.
+func (p *Producer) DeclareQueue(queue string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, name := range p.extra {
+		if name == queue {
+			return nil
+		}
+	}
+	p.extra = append(p.extra, queue)
+	if !p.up {
+		// Declared by the recovery.
+		return nil
+	}
+	return p.declare(p.conn, []string{queue})
 }
 
 // SendMessage publishes messages to specific queue
 func (p *Producer) SendMessage(queue, message string) error {
+	return p.SendMessageWithHeaders(queue, message, nil)
+}
+
+// SendMessageWithHeaders publishes messages with AMQP headers to specific queue.
+// While the broker is unreachable the message is buffered instead. It does not
+// wait for the broker, use Publish for that.
+func (p *Producer) SendMessageWithHeaders(queue, body string, headers amqp.Table) error {
+	return p.Publish(queue, body, headers).Err()
+}
+
+// SendRouted publishes a message with AMQP headers to the market data exchange
+// under a routing key built by RoutingKey.
+func (p *Producer) SendRouted(key, body string, headers amqp.Table) error {
+	return p.PublishTo(p.exchangeName(), key, body, headers).Err()
+}
+
+// Publish publishes a message with AMQP headers to specific queue. The returned
+// confirmation settles once the broker acked the message in confirm mode, and
+// once it was written to the channel otherwise. Messages the broker did not
+// confirm before a channel loss are published again after the recovery, those
+// it nacked up to NackRetries times. A message that goes to the spool settles
+// once it is appended to the spool, the broker acks of its replay are not reported.
+func (p *Producer) Publish(queue, body string, headers amqp.Table) *Confirmation {
+	return p.PublishTo("", queue, body, headers)
+}
+
+// PublishTo publishes a message with AMQP headers to an exchange, like Publish.
+func (p *Producer) PublishTo(exchange, key, body string, headers amqp.Table) *Confirmation {
+	msg := message{
+		id:       strconv.FormatUint(p.lastID.Add(1), 10),
+		exchange: exchange,
+		key:      key,
+		body:     body,
+		headers:  headers,
+		confirm:  newConfirmation(),
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.draining || p.closed.Load() {
+		msg.confirm.resolve(ErrProducerClosed)
+		return msg.confirm
+	}
+
+	if !p.up {
+		p.bufferMessage(msg)
+		return msg.confirm
+	}
+	if p.spooling {
+		// The spool is being replayed, the message goes after it.
+		p.spoolMessage(msg)
+		return msg.confirm
+	}
+	if err := p.publish(msg); err != nil {
+		// The channel is gone, watch reconnects and sends the message afterwards.
+		log.Printf("Failed to send message to %s, buffering until RabbitMQ is back: %v", msg.target(), err)
+		p.up = false
+		p.bufferMessage(msg)
+	}
+	return msg.confirm
+}
+
+// publish sends a message on the current channel, p.mu must be held. In
+// confirm mode the message is tracked until the broker acks it, and mandatory
+// when sent to a queue. A routing key nobody binds to is not an error.
+func (p *Producer) publish(msg message) error {
+	var tag uint64
+	if p.confirms != nil {
+		tag = p.confirms.track(msg)
+	}
 	err := p.ch.Publish(
-		"",
-		queue,
-		false,
+		msg.exchange,
+		msg.key,
+		p.confirms != nil && msg.exchange == "",
 		false,
 		amqp.Publishing{
+			Headers:     msg.headers,
 			ContentType: "text/plain",
-			Body:        []byte(message),
+			MessageId:   msg.id,
+			Body:        []byte(msg.body),
 		},
 	)
 	if err != nil {
-		return fmt.Errorf("failed to send message to queue %s: %v", queue, err)
+		if p.confirms != nil {
+			p.confirms.untrack(tag)
+		}
+		return fmt.Errorf("failed to send message to %s: %v", msg.target(), err)
+	}
+	if p.confirms == nil {
+		msg.confirm.resolve(nil)
 	}
 	return nil
 }
 
+// nacked schedules a message the broker refused to be published again. It is
+// settled with ErrNacked once the retries are used up. Republishing waits for
+// p.mu, so it never runs on the confirm listener.
+func (p *Producer) nacked(msg message) {
+	retries := p.cfg.Rabbit.NackRetries
+	if retries <= 0 {
+		retries = defaultNackRetries
+	}
+	if msg.attempts >= retries {
+		log.Printf("Message to %s was nacked %d times, giving up", msg.target(), msg.attempts+1)
+		p.dropped.Add(1)
+		msg.confirm.resolve(ErrNacked)
+		return
+	}
+	msg.attempts++
+	p.requeued.Add(1)
+	time.AfterFunc(time.Duration(msg.attempts)*nackDelay, func() {
+		defer p.requeued.Add(-1)
+		p.republish(msg)
+	})
+}
+
+// republish publishes a nacked message again. Unlike PublishTo it goes on while
+// draining, the message was taken before Shutdown.
+func (p *Producer) republish(msg message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch {
+	case p.closed.Load():
+		msg.confirm.resolve(ErrProducerClosed)
+	case !p.up:
+		p.bufferMessage(msg)
+	case p.spooling:
+		p.spoolMessage(msg)
+	default:
+		if err := p.publish(msg); err != nil {
+			log.Printf("Failed to republish message to %s, buffering until RabbitMQ is back: %v", msg.target(), err)
+			p.up = false
+			p.bufferMessage(msg)
+		}
+	}
+}
+
+// bufferMessage keeps a message until the connection is back, p.mu must be held.
+// A message that does not fit moves the buffer to the spool, without a spool it
+// is settled with ErrBufferFull.
+func (p *Producer) bufferMessage(msg message) {
+	if p.spooling {
+		p.spoolMessage(msg)
+		return
+	}
+	if len(p.buffer) >= p.bufferSize() {
+		if p.spool != nil {
+			p.spill()
+			p.spoolMessage(msg)
+			return
+		}
+		p.dropped.Add(1)
+		msg.confirm.resolve(ErrBufferFull)
+		return
+	}
+	p.buffer = append(p.buffer, msg)
+}
+
+// trimBuffer caps the buffer at the configured size once unconfirmed messages
+// were put back in it, p.mu must be held. The newest messages beyond it are
+// spooled, without a spool they are settled with ErrBufferFull.
+func (p *Producer) trimBuffer() {
+	size := p.bufferSize()
+	if len(p.buffer) <= size {
+		return
+	}
+	excess := p.buffer[size:]
+	p.buffer = p.buffer[:size:size]
+	for _, msg := range excess {
+		if p.spool != nil {
+			p.spoolMessage(msg)
+			continue
+		}
+		p.dropped.Add(1)
+		msg.confirm.resolve(ErrBufferFull)
+	}
+}
+
+func (p *Producer) bufferSize() int {
+	if p.cfg.Rabbit.BufferSize <= 0 {
+		return defaultBufferSize
+	}
+	return p.cfg.Rabbit.BufferSize
+}
+
+// pending returns the messages buffered, waiting for a confirm or to be
+// republished, p.mu must be held.
+func (p *Producer) pending() int {
+	pending := len(p.buffer) + int(p.requeued.Load())
+	if p.confirms != nil {
+		pending += p.confirms.outstanding()
+	}
+	return pending
+}
+
+// Connected reports whether messages are published right away rather than buffered.
+func (p *Producer) Connected() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.up
+}
+
+// Buffered returns the number of messages waiting for the connection to come back.
+func (p *Producer) Buffered() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.buffer)
+}
+
+// Dropped returns the number of messages dropped because the buffer was full,
+// they could not be spooled or the broker kept nacking them.
+func (p *Producer) Dropped() uint64 {
+	return p.dropped.Load()
+}
+
+// Shutdown refuses new publishes, waits for the ones in flight, for the buffer
+// to be sent and, in confirm mode, for the broker to confirm, then closes the
+// channel and connection. They are closed when ctx expires first as well. With
+// a spool, what is left is spooled for the next start and an outage is not
+// waited for.
+func (p *Producer) Shutdown(ctx context.Context) error {
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		ticker := time.NewTicker(drainInterval)
+		defer ticker.Stop()
+		for {
+			p.mu.Lock()
+			p.draining = true
+			pending := p.pending()
+			spill := p.spool != nil && !p.up
+			p.mu.Unlock()
+			if pending == 0 || spill {
+				return
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var err error
+	select {
+	case <-drained:
+		p.mu.Lock()
+		pending := p.pending()
+		p.mu.Unlock()
+		if pending > 0 && p.spool == nil {
+			err = fmt.Errorf("%d messages were not published or confirmed: %v", pending, ctx.Err())
+		}
+	case <-ctx.Done():
+		err = fmt.Errorf("producer did not drain before the deadline: %v", ctx.Err())
+	}
+	p.Close()
+	return err
+}
+
 func (p *Producer) Close() {
+	p.closed.Store(true)
+	p.cancel()
+
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
 	if p.ch != nil {
 		if err := p.ch.Close(); err != nil {
 			log.Printf("Error closing AMQP channel: %v", err)
@@ -84,4 +442,50 @@ func (p *Producer) Close() {
 		}
 	}
 	log.Println("RabbitMQ producer closed successfully")
+
+	if p.spool != nil {
+		p.closeSpool()
+		return
+	}
+	// Settle what can no longer be published, without waiting for a publish in flight.
+	if p.confirms != nil {
+		p.confirms.drop(ErrProducerClosed)
+	}
+	go func() {
+		p.mu.Lock()
+		buffer := p.buffer
+		p.buffer = nil
+		p.mu.Unlock()
+		for _, msg := range buffer {
+			msg.confirm.resolve(ErrProducerClosed)
+		}
+	}()
+}
+
+// closeSpool spools the messages that were not published or confirmed and
+// closes the spool. Unconfirmed messages may have reached the broker, they are
+// published twice then.
+func (p *Producer) closeSpool() {
+	closeSpool := func() {
+		var unsent []message
+		if p.confirms != nil {
+			_, unsent = p.confirms.reset()
+		}
+		p.buffer = append(unsent, p.buffer...)
+		p.spill()
+		if err := p.spool.Close(); err != nil {
+			log.Printf("Error closing the spool: %v", err)
+		}
+	}
+	// Do not wait for a publish in flight, it may block on a dead connection.
+	if p.mu.TryLock() {
+		defer p.mu.Unlock()
+		closeSpool()
+		return
+	}
+	go func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		closeSpool()
+	}()
 }
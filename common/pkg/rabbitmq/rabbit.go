@@ -2,9 +2,11 @@ package rabbitmq
 
 import (
 	"common/config"
+	"context"
 	"github.com/streadway/amqp"
 )
 
 type RabbitConnection interface {
 	ConnectWithRetries(cfg *config.Config, retries int) (*amqp.Connection, error)
+	ConnectContext(ctx context.Context, cfg *config.Config, retries int) (*amqp.Connection, error)
 }
@@ -0,0 +1,127 @@
+package rabbitmq
+
+import (
+	"common/pkg/log"
+	"common/pkg/retry"
+	"fmt"
+	"github.com/streadway/amqp"
+	"go.uber.org/zap"
+)
+
+// watch waits for the channel or connection to close and recovers them until
+// the producer is closed.
+func (p *Producer) watch(conn *amqp.Connection, ch *amqp.Channel) {
+	for {
+		connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+		var cause *amqp.Error
+		select {
+		case cause = <-connClosed:
+		case cause = <-chClosed:
+		}
+		if p.closed.Load() {
+			return
+		}
+		log.Logger.Error(fmt.Sprintf("RabbitMQ channel closed, reconnecting: %v", cause))
+
+		p.mu.Lock()
+		p.up = false
+		p.mu.Unlock()
+
+		var ok bool
+		if conn, ch, ok = p.reconnect(conn); !ok {
+			return
+		}
+		log.Logger.Info("RabbitMQ producer recovered")
+	}
+}
+
+// reconnect re-opens the channel, on a new connection if the old one is gone, and
+// resumes publishing. It returns false once the producer is closed.
+func (p *Producer) reconnect(conn *amqp.Connection) (*amqp.Connection, *amqp.Channel, bool) {
+	// Recovery never gives up, only each redial is capped by the policy.
+	policy := p.cfg.Rabbit.Reconnect
+	policy.MaxAttempts = 0
+	backoff := retry.NewBackoff(policy)
+	if c, ok := p.connection.(*Connection); ok {
+		// Waits between recovery attempts are reported like those of a dial.
+		backoff.OnRetry = c.OnRetry
+	}
+
+	for !p.closed.Load() {
+		err := func() error {
+			if conn.IsClosed() {
+				c, err := p.connection.ConnectContext(p.stop, p.cfg, 0)
+				if err != nil {
+					return err
+				}
+				conn = c
+			}
+			ch, err := conn.Channel()
+			if err != nil {
+				return fmt.Errorf("failed to open a channel: %v", err)
+			}
+			return p.resume(conn, ch)
+		}()
+		if err == nil {
+			p.connMu.Lock()
+			ch := p.ch
+			p.connMu.Unlock()
+			return conn, ch, true
+		}
+
+		log.Logger.Error("Failed to recover the RabbitMQ producer", zap.Error(err))
+		if err := backoff.Wait(p.stop); err != nil {
+			break
+		}
+	}
+	if !conn.IsClosed() {
+		_ = conn.Close()
+	}
+	return nil, nil, false
+}
+
+// resume declares the topology on a new channel, sends the buffered messages
+// and switches publishing over to it.
+func (p *Producer) resume(conn *amqp.Connection, ch *amqp.Channel) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed.Load() {
+		_ = ch.Close()
+		return ErrProducerClosed
+	}
+	if err := p.declareTopology(conn, ch); err != nil {
+		_ = ch.Close()
+		return err
+	}
+	if p.confirms != nil {
+		// Whatever the old channel did not confirm goes out again, ahead of the buffer.
+		gen, unconfirmed := p.confirms.reset()
+		p.buffer = append(unconfirmed, p.buffer...)
+		p.trimBuffer()
+		if err := p.confirms.listen(ch, gen); err != nil {
+			_ = ch.Close()
+			return err
+		}
+	}
+
+	p.connMu.Lock()
+	p.conn, p.ch = conn, ch
+	p.connMu.Unlock()
+
+	for i, msg := range p.buffer {
+		if err := p.publish(msg); err != nil {
+			p.buffer = p.buffer[i:]
+			return err
+		}
+	}
+	if len(p.buffer) > 0 {
+		log.Logger.Info(fmt.Sprintf("Sent %d messages buffered during the RabbitMQ outage", len(p.buffer)))
+	}
+	p.buffer = nil
+	p.up = true
+	p.startReplay()
+	return nil
+}
@@ -0,0 +1,173 @@
+package rabbitmq
+
+import (
+	"common/pkg/log"
+	"common/pkg/spool"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/streadway/amqp"
+	"go.uber.org/zap"
+	"strconv"
+	"time"
+)
+
+// replayBatch is how many spooled messages are sent per hold of p.mu.
+const replayBatch = 500
+
+type spooledMessage struct {
+	Exchange string     `json:"exchange,omitempty"`
+	Key      string     `json:"key"`
+	Body     string     `json:"body"`
+	Headers  amqp.Table `json:"headers,omitempty"`
+}
+
+// spoolMessage writes a message to the spool, p.mu must be held. A spooled
+// message is settled once it is appended, see Confirmation.
+func (p *Producer) spoolMessage(msg message) {
+	data, err := json.Marshal(spooledMessage{Exchange: msg.exchange, Key: msg.key, Body: msg.body, Headers: msg.headers})
+	if err == nil {
+		err = p.spool.Append(data)
+	}
+	if err != nil {
+		log.Logger.Error(fmt.Sprintf("Failed to spool message to %s", msg.target()), zap.Error(err))
+		p.dropped.Add(1)
+		msg.confirm.resolve(err)
+		return
+	}
+	p.spooling = true
+	msg.confirm.resolve(nil)
+}
+
+// spill moves the buffer to the spool, p.mu must be held. Once messages are
+// spooled every later message goes there too until the spool is replayed,
+// which keeps them in order.
+func (p *Producer) spill() {
+	buffer := p.buffer
+	p.buffer = nil
+	for _, msg := range buffer {
+		p.spoolMessage(msg)
+	}
+}
+
+// startReplay sends the spool in the background once the producer is up, p.mu must be held.
+func (p *Producer) startReplay() {
+	if p.spooling && p.up && !p.replaying {
+		p.replaying = true
+		go p.replay()
+	}
+}
+
+// replay publishes the spooled messages in batches. Publishes made meanwhile
+// are appended to the spool, so the replay ends once it caught up with them.
+func (p *Producer) replay() {
+	sent := 0
+	for {
+		done, n, err := p.replayBatch()
+		sent += n
+		if err != nil {
+			log.Logger.Error("Failed to replay the spool", zap.Error(err))
+		}
+		if done {
+			if sent > 0 {
+				log.Logger.Info(fmt.Sprintf("Sent %d messages spooled during the RabbitMQ outage", sent))
+			}
+			return
+		}
+	}
+}
+
+func (p *Producer) replayBatch() (bool, int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.up || p.closed.Load() {
+		// Resumed by the next recovery.
+		p.replaying = false
+		return true, 0, nil
+	}
+	records, err := p.spool.Peek(replayBatch)
+	if len(records) == 0 && errors.Is(err, spool.ErrCorrupt) {
+		// Nothing after a corrupt record reads back, the rest of its segment
+		// is given up and the replay goes on with the next one.
+		lost, err := p.spool.Discard()
+		log.Logger.Error(fmt.Sprintf("Dropped %d spooled messages behind a corrupt record", lost))
+		return false, 0, err
+	}
+	if len(records) == 0 {
+		// Publishing goes straight to the channel again.
+		p.spooling = false
+		p.replaying = false
+		return true, 0, err
+	}
+
+	for i, rec := range records {
+		var sm spooledMessage
+		if err := json.Unmarshal(rec.Data, &sm); err != nil {
+			log.Logger.Error("Skipping an unreadable spooled message", zap.Error(err))
+			continue
+		}
+		msg := message{
+			id:       strconv.FormatUint(p.lastID.Add(1), 10),
+			exchange: sm.Exchange,
+			key:      sm.Key,
+			body:     sm.Body,
+			headers:  sm.Headers,
+			confirm:  newConfirmation(),
+		}
+		if err := p.publish(msg); err != nil {
+			// The channel is gone, watch recovers it and the replay continues from here.
+			p.up = false
+			p.replaying = false
+			if cerr := p.spool.Commit(i); cerr != nil {
+				return true, i, cerr
+			}
+			return true, i, err
+		}
+	}
+	return false, len(records), p.spool.Commit(len(records))
+}
+
+// Spooled returns the number of messages waiting in the spool.
+func (p *Producer) Spooled() int {
+	if p.spool == nil {
+		return 0
+	}
+	return p.spool.Len()
+}
+
+// SpoolSize returns the size of the spool on disk in bytes.
+func (p *Producer) SpoolSize() int64 {
+	if p.spool == nil {
+		return 0
+	}
+	return p.spool.Size()
+}
+
+// SpoolAge returns how long the oldest spooled message has been waiting.
+func (p *Producer) SpoolAge() time.Duration {
+	if p.spool == nil {
+		return 0
+	}
+	oldest := p.spool.Oldest()
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
+// SpoolCorrupt returns the number of spooled messages lost to corrupt records.
+func (p *Producer) SpoolCorrupt() uint64 {
+	if p.spool == nil {
+		return 0
+	}
+	return p.spool.Corrupt()
+}
+
+// SpoolDropped returns the number of spooled messages dropped by the size and age caps.
+func (p *Producer) SpoolDropped() uint64 {
+	if p.spool == nil {
+		return 0
+	}
+	return p.spool.Dropped()
+}
@@ -0,0 +1,161 @@
+package rabbitmq
+
+import (
+	"common/config"
+	"common/pkg/log"
+	"common/pkg/retry"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/streadway/amqp"
+	"go.uber.org/zap"
+	"time"
+)
+
+const defaultStreamPrefetch = 1000
+
+// Offset selects where a stream consumer starts reading.
+type Offset struct {
+	value interface{}
+}
+
+// First starts at the oldest message the stream retains.
+func First() Offset { return Offset{value: "first"} }
+
+// Last starts at the last chunk of the stream, a few of the latest messages.
+func Last() Offset { return Offset{value: "last"} }
+
+// Next starts with the messages published from now on.
+func Next() Offset { return Offset{value: "next"} }
+
+// At starts at an offset, such as the one after the last message handled.
+func At(offset int64) Offset { return Offset{value: offset} }
+
+// Since starts at the messages published from t on. The broker starts at the
+// chunk containing t, so a few earlier messages may come first.
+func Since(t time.Time) Offset { return Offset{value: t} }
+
+func (o Offset) String() string {
+	return fmt.Sprint(o.value)
+}
+
+// StreamMessage is a message read from a stream.
+type StreamMessage struct {
+	// Offset is the position of the message in the stream, At(Offset+1) resumes after it.
+	Offset     int64
+	RoutingKey string
+	Headers    amqp.Table
+	Body       []byte
+}
+
+// StreamConsumer reads a stream queue, such as the trade stream of the producer.
+// Streams are not destructive, every consumer reads from the offset it chooses.
+type StreamConsumer struct {
+	cfg        *config.Config
+	connection RabbitConnection
+	stream     string
+	// Prefetch is how many messages the broker sends ahead of the acks.
+	Prefetch int
+}
+
+func NewStreamConsumer(cfg *config.Config, connection RabbitConnection, stream string) *StreamConsumer {
+	return &StreamConsumer{
+		cfg:        cfg,
+		connection: connection,
+		stream:     stream,
+		Prefetch:   defaultStreamPrefetch,
+	}
+}
+
+// handlerError carries the error of the handler out of a consume attempt.
+type handlerError struct {
+	err error
+}
+
+func (e handlerError) Error() string {
+	return e.err.Error()
+}
+
+// Consume reads the stream from an offset and hands every message to handle, in
+// order, until ctx is done or handle fails. A lost connection is re-established
+// with the reconnect policy and reading resumes after the last handled message.
+// It returns the error of handle, or why reconnecting gave up.
+func (c *StreamConsumer) Consume(ctx context.Context, from Offset, handle func(StreamMessage) error) error {
+	backoff := retry.NewBackoff(c.cfg.Rabbit.Reconnect)
+	for {
+		// Dialing retries on its own, with the same policy.
+		conn, err := c.connection.ConnectContext(ctx, c.cfg, 0)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		last, err := c.consume(ctx, conn, from, handle, backoff)
+		if last != nil {
+			from = At(*last + 1)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		var herr handlerError
+		if errors.As(err, &herr) {
+			return herr.err
+		}
+		log.Logger.Error(fmt.Sprintf("Stream consumer of %s lost its connection, resuming from %s", c.stream, from), zap.Error(err))
+		if err := backoff.Wait(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// consume reads until the connection fails and returns the offset of the last
+// message handled, nil if there was none. It closes conn.
+func (c *StreamConsumer) consume(ctx context.Context, conn *amqp.Connection, from Offset, handle func(StreamMessage) error, backoff *retry.Backoff) (*int64, error) {
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a channel: %v", err)
+	}
+	// Streams refuse consumers without a prefetch limit.
+	if err := ch.Qos(c.Prefetch, 0, false); err != nil {
+		return nil, fmt.Errorf("failed to set the prefetch: %v", err)
+	}
+	deliveries, err := ch.Consume(c.stream, "", false, false, false, false, amqp.Table{"x-stream-offset": from.value})
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume stream %s: %v", c.stream, err)
+	}
+	backoff.Connected()
+	defer backoff.Disconnected()
+
+	var last *int64
+	for {
+		select {
+		case <-ctx.Done():
+			return last, nil
+		case d, ok := <-deliveries:
+			if !ok {
+				return last, fmt.Errorf("stream %s was closed", c.stream)
+			}
+			offset, _ := d.Headers["x-stream-offset"].(int64)
+			msg := StreamMessage{
+				Offset:     offset,
+				RoutingKey: d.RoutingKey,
+				Headers:    d.Headers,
+				Body:       d.Body,
+			}
+			if err := handle(msg); err != nil {
+				return last, handlerError{err: err}
+			}
+			// Acks only return credit to the broker, streams keep their messages.
+			if err := d.Ack(false); err != nil {
+				return &offset, fmt.Errorf("failed to ack stream message: %v", err)
+			}
+			last = &offset
+		}
+	}
+}
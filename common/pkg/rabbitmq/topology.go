@@ -0,0 +1,314 @@
+package rabbitmq
+
+import (
+	"common/config"
+	"common/pkg/log"
+	"errors"
+	"fmt"
+	"github.com/streadway/amqp"
+	"strings"
+)
+
+const (
+	defaultExchange = "market_data"
+	// defaultStreamKey feeds every trade into the stream.
+	defaultStreamKey = "*.trade.#"
+	// driftFail refuses to connect when a queue differs from its configuration.
+	driftFail = "fail"
+)
+
+// legacyQueues are bound to the data types they were fed before the exchange.
+var legacyQueues = map[string]string{
+	"trade":     "trade_queue",
+	"ticker":    "ticker_queue",
+	"orderbook": "orderbook_queue",
+	"myOrder":   "my_order_queue",
+	"myAsset":   "my_asset_queue",
+}
+
+// RoutingKey returns the routing key of a market data message, such as
+// upbit.trade.KRW-BTC. Data without a market is routed as upbit.myAsset.
+// Dots in a market would split it into several words and become underscores.
+func RoutingKey(platform, dataType, market string) string {
+	if market == "" {
+		return platform + "." + dataType
+	}
+	return platform + "." + dataType + "." + strings.ReplaceAll(market, ".", "_")
+}
+
+func (p *Producer) exchangeName() string {
+	if p.cfg.Rabbit.Exchange.Name == "" {
+		return defaultExchange
+	}
+	return p.cfg.Rabbit.Exchange.Name
+}
+
+// declareTopology declares the exchange, the queues and their bindings on a new
+// connection, p.mu must be held once the producer runs.
+func (p *Producer) declareTopology(conn *amqp.Connection, ch *amqp.Channel) error {
+	exchange := p.exchangeName()
+	if err := ch.ExchangeDeclare(exchange, amqp.ExchangeTopic, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("producer failed to declare exchange %s: %s", exchange, err)
+	}
+
+	p.drifted = make(map[string]string)
+	if err := p.declare(conn, append(queues[:len(queues):len(queues)], p.extra...)); err != nil {
+		return err
+	}
+	if p.cfg.Rabbit.Exchange.LegacyQueues {
+		for dataType, queue := range legacyQueues {
+			if err := p.declare(conn, []string{queue}); err != nil {
+				return err
+			}
+			if err := bind(ch, queue, "*."+dataType+".#", exchange); err != nil {
+				return err
+			}
+		}
+	}
+	for _, b := range p.cfg.Rabbit.Exchange.Bindings {
+		if err := p.declare(conn, []string{b.Queue}); err != nil {
+			return err
+		}
+		for _, key := range b.Keys {
+			if err := bind(ch, b.Queue, key, exchange); err != nil {
+				return err
+			}
+		}
+	}
+	if stream := p.cfg.Rabbit.Stream; stream.Name != "" {
+		if err := p.declare(conn, []string{stream.Name}); err != nil {
+			return err
+		}
+		keys := stream.Keys
+		if len(keys) == 0 {
+			keys = []string{defaultStreamKey}
+		}
+		for _, key := range keys {
+			if err := bind(ch, stream.Name, key, exchange); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// declare declares queues with their configured settings. A queue that already
+// exists with other settings has drifted, it is kept as is and reported, or
+// fails the declaration with OnDrift set to fail.
+func (p *Producer) declare(conn *amqp.Connection, names []string) error {
+	for _, name := range names {
+		spec := p.queueSpec(name)
+		args, err := arguments(spec)
+		if err != nil {
+			return fmt.Errorf("invalid topology of queue %s: %v", name, err)
+		}
+		if spec.DeadLetterExchange != "" {
+			if err := declareDeadLetter(conn, spec.DeadLetterExchange); err != nil {
+				return err
+			}
+		}
+
+		// A mismatch closes the channel, so every queue is declared on its own.
+		err = withChannel(conn, func(ch *amqp.Channel) error {
+			_, err := ch.QueueDeclare(name, *spec.Durable, *spec.AutoDelete, false, false, args)
+			return err
+		})
+		if !isPreconditionFailed(err) {
+			if err != nil {
+				return fmt.Errorf("producer failed to declare queue %s: %s", name, err)
+			}
+			continue
+		}
+		p.drifted[name] = err.Error()
+		if p.cfg.Rabbit.Topology.OnDrift == driftFail {
+			return fmt.Errorf("queue %s differs from the configured topology: %s", name, err)
+		}
+		log.Logger.Error(fmt.Sprintf("Queue %s differs from the configured topology, keeping it as is: %s", name, err))
+	}
+	return nil
+}
+
+// queueSpec resolves the settings of a queue: its own entry, then the
+// defaults, then a durable classic queue. The trade stream takes its retention
+// instead of the defaults, which mostly do not apply to streams.
+func (p *Producer) queueSpec(name string) config.QueueSpec {
+	durable, autoDelete := true, false
+	spec := config.QueueSpec{Name: name, Durable: &durable, AutoDelete: &autoDelete}
+	if stream := p.cfg.Rabbit.Stream; stream.Name != "" && stream.Name == name {
+		merge(&spec, config.QueueSpec{
+			Type:           "stream",
+			MaxAge:         stream.MaxAge,
+			MaxLengthBytes: stream.MaxLengthBytes,
+			MaxSegmentSize: stream.MaxSegmentSize,
+		})
+	} else {
+		merge(&spec, p.cfg.Rabbit.Topology.Defaults)
+	}
+	for _, q := range p.cfg.Rabbit.Topology.Queues {
+		if q.Name == name {
+			merge(&spec, q)
+		}
+	}
+	return spec
+}
+
+func merge(spec *config.QueueSpec, over config.QueueSpec) {
+	if over.Durable != nil {
+		spec.Durable = over.Durable
+	}
+	if over.AutoDelete != nil {
+		spec.AutoDelete = over.AutoDelete
+	}
+	if over.Type != "" {
+		spec.Type = over.Type
+	}
+	if over.MessageTTL > 0 {
+		spec.MessageTTL = over.MessageTTL
+	}
+	if over.MaxLength > 0 {
+		spec.MaxLength = over.MaxLength
+	}
+	if over.MaxLengthBytes > 0 {
+		spec.MaxLengthBytes = over.MaxLengthBytes
+	}
+	if over.Overflow != "" {
+		spec.Overflow = over.Overflow
+	}
+	if over.DeadLetterExchange != "" {
+		spec.DeadLetterExchange = over.DeadLetterExchange
+	}
+	if over.DeadLetterRoutingKey != "" {
+		spec.DeadLetterRoutingKey = over.DeadLetterRoutingKey
+	}
+	if over.MaxAge > 0 {
+		spec.MaxAge = over.MaxAge
+	}
+	if over.MaxSegmentSize > 0 {
+		spec.MaxSegmentSize = over.MaxSegmentSize
+	}
+}
+
+// arguments returns the x-arguments of a queue.
+func arguments(spec config.QueueSpec) (amqp.Table, error) {
+	args := amqp.Table{}
+	switch spec.Type {
+	case "", "classic":
+	case "quorum", "stream":
+		if !*spec.Durable || *spec.AutoDelete {
+			return nil, fmt.Errorf("%s queues must be durable and not auto-delete", spec.Type)
+		}
+	default:
+		return nil, fmt.Errorf("unknown queue type %q", spec.Type)
+	}
+	if spec.Type == "stream" {
+		if spec.MessageTTL > 0 || spec.MaxLength > 0 || spec.Overflow != "" || spec.DeadLetterExchange != "" {
+			return nil, fmt.Errorf("stream queues take no message TTL, max length, overflow or dead-lettering, use maxAge and maxLengthBytes")
+		}
+	} else if spec.MaxAge > 0 || spec.MaxSegmentSize > 0 {
+		return nil, fmt.Errorf("maxAge and maxSegmentSize only apply to stream queues")
+	}
+	if spec.Type != "" {
+		args["x-queue-type"] = spec.Type
+	}
+	if spec.MessageTTL > 0 {
+		args["x-message-ttl"] = spec.MessageTTL.Milliseconds()
+	}
+	if spec.MaxLength > 0 {
+		args["x-max-length"] = spec.MaxLength
+	}
+	if spec.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = spec.MaxLengthBytes
+	}
+	switch spec.Overflow {
+	case "":
+	case "drop-head", "reject-publish", "reject-publish-dlx":
+		args["x-overflow"] = spec.Overflow
+	default:
+		return nil, fmt.Errorf("unknown overflow mode %q", spec.Overflow)
+	}
+	if spec.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = spec.DeadLetterExchange
+	}
+	if spec.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = spec.DeadLetterRoutingKey
+	}
+	if spec.MaxAge > 0 {
+		// The broker takes Y, M, D, h, m or s units.
+		args["x-max-age"] = fmt.Sprintf("%ds", int64(spec.MaxAge.Seconds()))
+	}
+	if spec.MaxSegmentSize > 0 {
+		args["x-stream-max-segment-size-bytes"] = spec.MaxSegmentSize
+	}
+	return args, nil
+}
+
+// declareDeadLetter declares a missing dead-letter exchange as a fanout with a
+// durable queue of the same name, so that dead letters are not lost.
+func declareDeadLetter(conn *amqp.Connection, exchange string) error {
+	err := withChannel(conn, func(ch *amqp.Channel) error {
+		return ch.ExchangeDeclarePassive(exchange, amqp.ExchangeFanout, true, false, false, false, nil)
+	})
+	if err == nil {
+		return nil
+	}
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.NotFound {
+		return fmt.Errorf("producer failed to check dead-letter exchange %s: %s", exchange, err)
+	}
+
+	return withChannel(conn, func(ch *amqp.Channel) error {
+		if err := ch.ExchangeDeclare(exchange, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+			return fmt.Errorf("producer failed to declare dead-letter exchange %s: %s", exchange, err)
+		}
+		if _, err := ch.QueueDeclare(exchange, true, false, false, false, nil); err != nil {
+			return fmt.Errorf("producer failed to declare dead-letter queue %s: %s", exchange, err)
+		}
+		return bind(ch, exchange, "", exchange)
+	})
+}
+
+// withChannel runs fn on a channel of its own, which a failed declaration may close.
+func withChannel(conn *amqp.Connection, fn func(ch *amqp.Channel) error) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open a channel: %v", err)
+	}
+	err = fn(ch)
+	if err == nil {
+		_ = ch.Close()
+	}
+	return err
+}
+
+func isPreconditionFailed(err error) bool {
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed
+}
+
+func bind(ch *amqp.Channel, queue, key, exchange string) error {
+	if err := ch.QueueBind(queue, key, exchange, false, nil); err != nil {
+		return fmt.Errorf("producer failed to bind queue %s to %s: %s", queue, key, err)
+	}
+	return nil
+}
+
+// Drifted returns the queues that exist with other settings than configured and
+// the broker's explanation, as of the last connect.
+func (p *Producer) Drifted() map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	drifted := make(map[string]string, len(p.drifted))
+	for name, reason := range p.drifted {
+		drifted[name] = reason
+	}
+	return drifted
+}
+
+// target names where a message goes in logs.
+func (m message) target() string {
+	if m.exchange == "" {
+		return "queue " + m.key
+	}
+	return fmt.Sprintf("exchange %s as %s", m.exchange, m.key)
+}
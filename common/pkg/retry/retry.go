@@ -0,0 +1,139 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ErrMaxAttempts is returned by Wait once the policy allows no further attempt.
+var ErrMaxAttempts = errors.New("maximum reconnect attempts reached")
+
+// Policy describes how reconnects are spaced out.
+type Policy struct {
+	// InitialDelay is the delay before the first retry.
+	InitialDelay time.Duration `mapstructure:"initialDelay"`
+	// MaxDelay caps the delay between two attempts.
+	MaxDelay time.Duration `mapstructure:"maxDelay"`
+	// Multiplier grows the delay after every failed attempt.
+	Multiplier float64 `mapstructure:"multiplier"`
+	// Jitter picks a random delay between zero and the computed one (full jitter).
+	Jitter bool `mapstructure:"jitter"`
+	// MaxAttempts stops retrying after that many consecutive failures, zero retries forever.
+	MaxAttempts int `mapstructure:"maxAttempts"`
+	// ResetAfter forgets previous failures once a connection stayed up that long.
+	ResetAfter time.Duration `mapstructure:"resetAfter"`
+}
+
+// DefaultPolicy returns the policy used for unset fields.
+func DefaultPolicy() Policy {
+	return Policy{
+		InitialDelay: time.Second,
+		MaxDelay:     2 * time.Minute,
+		Multiplier:   2,
+		Jitter:       true,
+		ResetAfter:   time.Minute,
+	}
+}
+
+// withDefaults fills the unset fields of p from DefaultPolicy.
+func (p Policy) withDefaults() Policy {
+	d := DefaultPolicy()
+	if p.InitialDelay <= 0 {
+		p.InitialDelay = d.InitialDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = d.MaxDelay
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = d.Multiplier
+	}
+	if p.ResetAfter <= 0 {
+		p.ResetAfter = d.ResetAfter
+	}
+	return p
+}
+
+// Backoff tracks the consecutive failures of one connection. It is not safe for
+// concurrent use.
+type Backoff struct {
+	policy      Policy
+	attempt     int
+	connectedAt time.Time
+	rand        *rand.Rand
+
+	// OnRetry is called with the attempt number and delay before every wait.
+	OnRetry func(attempt int, delay time.Duration)
+}
+
+func NewBackoff(policy Policy) *Backoff {
+	return &Backoff{
+		policy: policy.withDefaults(),
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Attempt returns the number of consecutive failed attempts.
+func (b *Backoff) Attempt() int {
+	return b.attempt
+}
+
+// Next registers a failed attempt and returns the delay before the next one.
+// It returns false once MaxAttempts is exhausted.
+func (b *Backoff) Next() (time.Duration, bool) {
+	b.attempt++
+	if b.policy.MaxAttempts > 0 && b.attempt > b.policy.MaxAttempts {
+		return 0, false
+	}
+
+	delay := float64(b.policy.InitialDelay) * math.Pow(b.policy.Multiplier, float64(b.attempt-1))
+	if delay > float64(b.policy.MaxDelay) {
+		delay = float64(b.policy.MaxDelay)
+	}
+	if b.policy.Jitter {
+		delay = b.rand.Float64() * delay
+	}
+	return time.Duration(delay), true
+}
+
+// Wait registers a failed attempt and sleeps until the next one is due.
+func (b *Backoff) Wait(ctx context.Context) error {
+	delay, ok := b.Next()
+	if !ok {
+		return ErrMaxAttempts
+	}
+	if b.OnRetry != nil {
+		b.OnRetry(b.attempt, delay)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Connected records that a connection was established.
+func (b *Backoff) Connected() {
+	b.connectedAt = time.Now()
+}
+
+// Disconnected records that the connection was lost. Failures are forgotten
+// when it stayed up for ResetAfter.
+func (b *Backoff) Disconnected() {
+	if !b.connectedAt.IsZero() && time.Since(b.connectedAt) >= b.policy.ResetAfter {
+		b.Reset()
+	}
+	b.connectedAt = time.Time{}
+}
+
+// Reset forgets all failed attempts.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,624 @@
+package spool
+
+import (
+	"bufio"
+	"common/pkg/log"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSegmentSize  = 64 << 20
+	defaultSyncInterval = time.Second
+	segmentSuffix       = ".seg"
+	cursorFile          = "cursor"
+	// headerSize is the record length, its checksum and the time it was appended.
+	headerSize = 4 + 4 + 8
+)
+
+// ErrCorrupt is returned for a record whose checksum does not match.
+var ErrCorrupt = errors.New("spool record is corrupt")
+
+type Options struct {
+	Dir string
+	// SegmentSize is the size at which a new segment file is started.
+	SegmentSize int64
+	// MaxSize drops the oldest segments once the spool grows beyond it, zero keeps everything.
+	MaxSize int64
+	// MaxAge drops segments whose newest record is older than that, zero keeps everything.
+	MaxAge time.Duration
+	// SyncInterval bounds how long an append waits to be flushed to disk, one
+	// second by default. Segments are flushed when they are finished and on Close.
+	SyncInterval time.Duration
+}
+
+// Record is a spooled payload and the time it was appended.
+type Record struct {
+	Data []byte
+	Time time.Time
+}
+
+type segment struct {
+	seq     uint64
+	size    int64
+	records int
+	newest  time.Time
+	// sealed is set once a failed write could not be undone, appends go to the next segment.
+	sealed bool
+}
+
+type position struct {
+	seq    uint64
+	offset int64
+}
+
+// Spool is a write-ahead log of append-only segment files. Records are read
+// back in order with Peek and removed with Commit, the read position survives
+// restarts.
+type Spool struct {
+	opts Options
+
+	mu       sync.Mutex
+	segments []*segment
+	writer   *os.File
+	cursor   position
+	// pending is the number of records after the cursor.
+	pending int
+	dropped uint64
+	// corrupt is the number of records given up by Discard.
+	corrupt uint64
+	// syncedAt is when the writer was last flushed to disk, flush flushes the
+	// appends left unsynced by Append once SyncInterval is over.
+	syncedAt time.Time
+	flush    *time.Timer
+}
+
+// Open opens the spool in opts.Dir, creating it if needed.
+func Open(opts Options) (*Spool, error) {
+	if opts.Dir == "" {
+		return nil, fmt.Errorf("spool directory is not configured")
+	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = defaultSyncInterval
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %v", err)
+	}
+
+	s := &Spool{opts: opts}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load scans the segment files and the cursor left by a previous run.
+func (s *Spool) load() error {
+	entries, err := os.ReadDir(s.opts.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to read spool directory: %v", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seg := &segment{seq: seq}
+		if err := s.scan(seg); err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+
+	if data, err := os.ReadFile(filepath.Join(s.opts.Dir, cursorFile)); err == nil && len(data) == 16 {
+		s.cursor = position{seq: binary.BigEndian.Uint64(data[:8]), offset: int64(binary.BigEndian.Uint64(data[8:]))}
+	}
+	if len(s.segments) > 0 && s.cursor.seq < s.segments[0].seq {
+		s.cursor = position{seq: s.segments[0].seq}
+	}
+
+	for _, seg := range s.segments {
+		if seg.seq < s.cursor.seq {
+			continue
+		}
+		s.pending += seg.records
+		if seg.seq == s.cursor.seq && s.cursor.offset > 0 {
+			s.pending -= s.countUntil(seg, s.cursor.offset)
+		}
+	}
+	return nil
+}
+
+// scan counts the records of a segment and truncates it at the first record
+// that does not read back, a torn write at its end for instance. Records after
+// a corrupt one cannot be found again, the bytes dropped are logged.
+func (s *Spool) scan(seg *segment) error {
+	path := s.path(seg.seq)
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open spool segment: %v", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat spool segment: %v", err)
+	}
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		rec, n, err := readRecord(r, info.Size()-offset)
+		if err != nil {
+			break
+		}
+		offset += n
+		seg.records++
+		seg.newest = rec.Time
+	}
+	seg.size = offset
+	if dropped := info.Size() - offset; dropped > 0 {
+		log.Logger.Warn(fmt.Sprintf("Truncating spool segment %s at offset %d, dropping %d bytes that do not read back as records", path, offset, dropped))
+		if err := os.Truncate(path, offset); err != nil {
+			return fmt.Errorf("failed to truncate spool segment: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *Spool) countUntil(seg *segment, until int64) int {
+	f, err := os.Open(s.path(seg.seq))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	count := 0
+	for offset < until {
+		_, n, err := readRecord(r, seg.size-offset)
+		if err != nil {
+			break
+		}
+		offset += n
+		count++
+	}
+	return count
+}
+
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.opts.Dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+// Append adds a record at the end of the spool.
+func (s *Spool) Append(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.enforceCaps()
+
+	seg, err := s.writable()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	buf := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(now.UnixNano()))
+	copy(buf[headerSize:], data)
+	if _, err := s.writer.Write(buf); err != nil {
+		s.discardTail(seg)
+		return fmt.Errorf("failed to write to spool: %v", err)
+	}
+	if since := now.Sub(s.syncedAt); since >= s.opts.SyncInterval {
+		if err := s.writer.Sync(); err != nil {
+			return fmt.Errorf("failed to sync spool segment: %v", err)
+		}
+		s.syncedAt = now
+	} else if s.flush == nil {
+		s.flush = time.AfterFunc(s.opts.SyncInterval-since, s.sync)
+	}
+
+	seg.size += int64(len(buf))
+	seg.records++
+	seg.newest = now
+	s.pending++
+	return nil
+}
+
+// sync flushes the segment being written to, for appends made since the last
+// flush when the spool went quiet.
+func (s *Spool) sync() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.flush = nil
+	if s.writer == nil {
+		return
+	}
+	if err := s.writer.Sync(); err != nil {
+		log.Logger.Error(fmt.Sprintf("Failed to sync spool segment: %v", err))
+		return
+	}
+	s.syncedAt = time.Now()
+}
+
+// discardTail removes what a failed write left after the last record of seg,
+// so that the next record starts at seg.size. A segment that cannot be
+// truncated is sealed and appends go to a new one, the next Open truncates it.
+func (s *Spool) discardTail(seg *segment) {
+	if err := s.writer.Truncate(seg.size); err == nil {
+		return
+	}
+	seg.sealed = true
+	_ = s.writer.Close()
+	s.writer = nil
+}
+
+// writable returns the segment to append to, starting a new one when the last is full.
+func (s *Spool) writable() (*segment, error) {
+	if n := len(s.segments); n > 0 && s.writer != nil && s.segments[n-1].size < s.opts.SegmentSize {
+		return s.segments[n-1], nil
+	}
+	if s.writer != nil {
+		if err := s.writer.Sync(); err != nil {
+			return nil, fmt.Errorf("failed to sync spool segment: %v", err)
+		}
+		if err := s.writer.Close(); err != nil {
+			return nil, fmt.Errorf("failed to close spool segment: %v", err)
+		}
+		s.writer = nil
+	}
+
+	var seg *segment
+	if n := len(s.segments); n > 0 && !s.segments[n-1].sealed && s.segments[n-1].size < s.opts.SegmentSize {
+		// Keep appending to the segment left by the previous run.
+		seg = s.segments[n-1]
+	} else {
+		seq := s.cursor.seq
+		if n > 0 {
+			seq = s.segments[n-1].seq + 1
+		}
+		seg = &segment{seq: seq}
+		s.segments = append(s.segments, seg)
+	}
+
+	f, err := os.OpenFile(s.path(seg.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spool segment: %v", err)
+	}
+	s.writer = f
+	return seg, nil
+}
+
+// enforceCaps drops the oldest segments beyond MaxSize or MaxAge, s.mu must be held.
+// The segment being written to is never dropped.
+func (s *Spool) enforceCaps() {
+	for len(s.segments) > 1 {
+		oldest := s.segments[0]
+		tooBig := s.opts.MaxSize > 0 && s.size() > s.opts.MaxSize
+		tooOld := s.opts.MaxAge > 0 && time.Since(oldest.newest) > s.opts.MaxAge
+		if !tooBig && !tooOld {
+			return
+		}
+		s.dropSegment(oldest)
+	}
+}
+
+func (s *Spool) dropSegment(seg *segment) {
+	unread := seg.records
+	if seg.seq == s.cursor.seq {
+		unread -= s.countUntil(seg, s.cursor.offset)
+	} else if seg.seq < s.cursor.seq {
+		unread = 0
+	}
+	s.pending -= unread
+	s.dropped += uint64(unread)
+
+	_ = os.Remove(s.path(seg.seq))
+	s.segments = s.segments[1:]
+	if s.cursor.seq <= seg.seq {
+		s.cursor = position{seq: s.segments[0].seq}
+	}
+}
+
+func (s *Spool) size() int64 {
+	var size int64
+	for _, seg := range s.segments {
+		size += seg.size
+	}
+	return size
+}
+
+// Peek returns up to max records from the read position without removing them.
+func (s *Spool) Peek(max int) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records []Record
+	pos := s.cursor
+	for _, seg := range s.segments {
+		if seg.seq < pos.seq || len(records) >= max {
+			continue
+		}
+		if seg.seq > pos.seq {
+			pos = position{seq: seg.seq}
+		}
+		recs, err := s.readFrom(seg, pos.offset, max-len(records))
+		if err != nil {
+			return records, err
+		}
+		records = append(records, recs...)
+	}
+	return records, nil
+}
+
+func (s *Spool) readFrom(seg *segment, offset int64, max int) ([]Record, error) {
+	if offset >= seg.size {
+		return nil, nil
+	}
+	f, err := os.Open(s.path(seg.seq))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spool segment: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to read spool segment: %v", err)
+	}
+
+	r := bufio.NewReader(io.LimitReader(f, seg.size-offset))
+	var records []Record
+	for len(records) < max {
+		rec, n, err := readRecord(r, seg.size-offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return records, err
+		}
+		offset += n
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// Commit removes the first n records, as returned by Peek. Segments read to
+// the end are deleted unless they are still written to.
+func (s *Spool) Commit(n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for n > 0 && len(s.segments) > 0 {
+		seg := s.segments[0]
+		if seg.seq < s.cursor.seq {
+			s.segments = s.segments[1:]
+			continue
+		}
+		skipped, offset, err := s.skip(seg, s.cursor.offset, n)
+		if err != nil {
+			return err
+		}
+		n -= skipped
+		s.pending -= skipped
+		s.cursor.offset = offset
+		if offset < seg.size {
+			break
+		}
+		if len(s.segments) == 1 {
+			break
+		}
+		_ = os.Remove(s.path(seg.seq))
+		s.segments = s.segments[1:]
+		s.cursor = position{seq: s.segments[0].seq}
+	}
+	return s.saveCursor()
+}
+
+func (s *Spool) skip(seg *segment, offset int64, n int) (int, int64, error) {
+	f, err := os.Open(s.path(seg.seq))
+	if err != nil {
+		return 0, offset, fmt.Errorf("failed to open spool segment: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, offset, fmt.Errorf("failed to read spool segment: %v", err)
+	}
+
+	r := bufio.NewReader(io.LimitReader(f, seg.size-offset))
+	skipped := 0
+	for skipped < n {
+		_, size, err := readRecord(r, seg.size-offset)
+		if err != nil {
+			break
+		}
+		offset += size
+		skipped++
+	}
+	return skipped, offset, nil
+}
+
+// Discard gives up the rest of the segment at the read position, which does
+// not read back past a corrupt record, so that Peek goes on with the next
+// segment. It returns the number of records lost.
+func (s *Spool) Discard() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, seg := range s.segments {
+		if seg.seq < s.cursor.seq {
+			continue
+		}
+		lost := seg.records - s.countUntil(seg, s.cursor.offsetIn(seg.seq))
+		if lost < 0 {
+			lost = 0
+		}
+		s.pending -= lost
+		s.corrupt += uint64(lost)
+
+		if i == len(s.segments)-1 {
+			// Still written to, reading goes on with the next append.
+			s.cursor = position{seq: seg.seq, offset: seg.size}
+		} else {
+			for _, read := range s.segments[:i+1] {
+				_ = os.Remove(s.path(read.seq))
+			}
+			s.segments = s.segments[i+1:]
+			s.cursor = position{seq: s.segments[0].seq}
+		}
+		return lost, s.saveCursor()
+	}
+	return 0, nil
+}
+
+func (s *Spool) saveCursor() error {
+	var data [16]byte
+	binary.BigEndian.PutUint64(data[:8], s.cursor.seq)
+	binary.BigEndian.PutUint64(data[8:], uint64(s.cursor.offset))
+
+	path := filepath.Join(s.opts.Dir, cursorFile)
+	tmp := path + ".tmp"
+	if err := writeSynced(tmp, data[:]); err != nil {
+		return fmt.Errorf("failed to save spool cursor: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to save spool cursor: %v", err)
+	}
+	return nil
+}
+
+// Len returns the number of records waiting to be read.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+// Size returns the size of the segment files in bytes.
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size()
+}
+
+// Dropped returns the number of unread records dropped by the size and age caps.
+func (s *Spool) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Corrupt returns the number of records given up by Discard.
+func (s *Spool) Corrupt() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.corrupt
+}
+
+// Oldest returns when the oldest unread record was appended, zero when there is none.
+func (s *Spool) Oldest() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending == 0 {
+		return time.Time{}
+	}
+	for _, seg := range s.segments {
+		if seg.seq < s.cursor.seq {
+			continue
+		}
+		recs, err := s.readFrom(seg, s.cursor.offsetIn(seg.seq), 1)
+		if err == nil && len(recs) > 0 {
+			return recs[0].Time
+		}
+	}
+	return time.Time{}
+}
+
+func (p position) offsetIn(seq uint64) int64 {
+	if seq == p.seq {
+		return p.offset
+	}
+	return 0
+}
+
+// writeSynced writes a file and flushes it to disk, so that renaming it over
+// the previous one never leaves an empty file behind a crash.
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.flush != nil {
+		s.flush.Stop()
+		s.flush = nil
+	}
+
+	if s.writer == nil {
+		return nil
+	}
+	err := s.writer.Sync()
+	if cerr := s.writer.Close(); err == nil {
+		err = cerr
+	}
+	s.writer = nil
+	return err
+}
+
+// readRecord reads the next record of a segment with left bytes remaining from
+// r. A length beyond them is a torn or corrupt header and is not allocated.
+func readRecord(r io.Reader, left int64) (Record, int64, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return Record{}, 0, ErrCorrupt
+		}
+		return Record{}, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if int64(length) > left-headerSize {
+		return Record{}, 0, ErrCorrupt
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return Record{}, 0, ErrCorrupt
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return Record{}, 0, ErrCorrupt
+	}
+	rec := Record{Data: data, Time: time.Unix(0, int64(binary.BigEndian.Uint64(header[8:16])))}
+	return rec, int64(headerSize) + int64(length), nil
+}
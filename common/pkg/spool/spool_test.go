@@ -0,0 +1,286 @@
+package spool
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func open(t *testing.T, opts Options) *Spool {
+	t.Helper()
+	s, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func appendAll(t *testing.T, s *Spool, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := s.Append([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// expect peeks n records and checks they are the given ones.
+func expect(t *testing.T, s *Spool, n int, want ...string) {
+	t.Helper()
+	records, err := s.Peek(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, rec := range records {
+		got = append(got, string(rec.Data))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Peek(%d) = %q, want %q", n, got, want)
+	}
+}
+
+func TestAppendPeekCommit(t *testing.T) {
+	// Two records per segment, so reads and commits cross segments.
+	s := open(t, Options{Dir: t.TempDir(), SegmentSize: 2 * (headerSize + 1)})
+	appendAll(t, s, 0, 5)
+
+	if s.Len() != 5 {
+		t.Fatalf("Len = %d, want 5", s.Len())
+	}
+	expect(t, s, 3, "0", "1", "2")
+	// Peek does not move the read position.
+	expect(t, s, 3, "0", "1", "2")
+
+	if err := s.Commit(3); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 2 {
+		t.Fatalf("Len = %d, want 2", s.Len())
+	}
+	expect(t, s, 10, "3", "4")
+
+	if err := s.Commit(2); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, s, 10)
+	if s.Len() != 0 || !s.Oldest().IsZero() {
+		t.Fatalf("Len = %d, Oldest = %s, want an empty spool", s.Len(), s.Oldest())
+	}
+
+	// Read segments are deleted, the one written to is kept.
+	segments, _ := filepath.Glob(filepath.Join(s.opts.Dir, "*"+segmentSuffix))
+	if len(segments) != 1 {
+		t.Fatalf("%d segment files left, want 1", len(segments))
+	}
+}
+
+func TestReopenResumesAtCursor(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{Dir: dir, SegmentSize: 2 * (headerSize + 1)}
+
+	s, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendAll(t, s, 0, 5)
+	if err := s.Commit(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = open(t, opts)
+	if s.Len() != 2 {
+		t.Fatalf("Len after reopening = %d, want 2", s.Len())
+	}
+	expect(t, s, 10, "3", "4")
+
+	// Appends go after the records left by the previous run.
+	appendAll(t, s, 5, 7)
+	expect(t, s, 10, "3", "4", "5", "6")
+}
+
+func TestTornTail(t *testing.T) {
+	tests := []struct {
+		name string
+		tail []byte
+	}{
+		{name: "half a header", tail: []byte{0, 0, 0}},
+		{name: "short payload", tail: header(8, []byte("1234"))},
+		{name: "length beyond the segment", tail: header(0xFFFFFFFF, nil)},
+		{name: "bad checksum", tail: append(header(1, nil), 'x')},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := Open(Options{Dir: dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendAll(t, s, 0, 3)
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			path := s.path(0)
+			size := fileSize(t, path)
+
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write(tt.tail); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			s = open(t, Options{Dir: dir})
+			if s.Len() != 3 {
+				t.Fatalf("Len = %d, want 3", s.Len())
+			}
+			if got := fileSize(t, path); got != size {
+				t.Fatalf("segment is %d bytes after reopening, want the torn tail truncated to %d", got, size)
+			}
+			appendAll(t, s, 3, 4)
+			expect(t, s, 10, "0", "1", "2", "3")
+		})
+	}
+}
+
+func TestFailedWriteIsDiscarded(t *testing.T) {
+	s := open(t, Options{Dir: t.TempDir()})
+	appendAll(t, s, 0, 2)
+
+	// What a write cut short by a full disk leaves behind.
+	if _, err := s.writer.Write(header(8, []byte("12"))); err != nil {
+		t.Fatal(err)
+	}
+	s.discardTail(s.segments[0])
+
+	appendAll(t, s, 2, 3)
+	expect(t, s, 10, "0", "1", "2")
+}
+
+func TestQuietSpoolIsSynced(t *testing.T) {
+	s := open(t, Options{Dir: t.TempDir(), SyncInterval: 20 * time.Millisecond})
+	// The first append syncs, the second is left for the timer.
+	appendAll(t, s, 0, 2)
+	appended := time.Now()
+	time.Sleep(100 * time.Millisecond)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.flush != nil || s.syncedAt.Before(appended) {
+		t.Fatalf("last synced at %s, want after the append at %s", s.syncedAt, appended)
+	}
+}
+
+func TestDiscardSkipsCorruptSegment(t *testing.T) {
+	s := open(t, Options{Dir: t.TempDir(), SegmentSize: 2 * (headerSize + 1)})
+	appendAll(t, s, 0, 6)
+
+	// Flip the payload of the first record of the second segment.
+	f, err := os.OpenFile(s.path(1), os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("x"), headerSize); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	records, err := s.Peek(10)
+	if len(records) != 2 || !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Peek = %d records, %v, want 2 and ErrCorrupt", len(records), err)
+	}
+	if err := s.Commit(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Peek(10); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Peek = %v, want ErrCorrupt", err)
+	}
+
+	lost, err := s.Discard()
+	if err != nil || lost != 2 {
+		t.Fatalf("Discard = %d, %v, want 2", lost, err)
+	}
+	if s.Corrupt() != 2 || s.Len() != 2 {
+		t.Fatalf("Corrupt = %d, Len = %d, want 2 and 2", s.Corrupt(), s.Len())
+	}
+	expect(t, s, 10, "4", "5")
+}
+
+func TestReadRecordBoundsLength(t *testing.T) {
+	// A corrupt length must not be allocated.
+	data := header(0xFFFFFFFF, nil)
+	if _, _, err := readRecord(bytes.NewReader(data), int64(len(data))); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("readRecord = %v, want ErrCorrupt", err)
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	// One record per segment, the cap holds three of them.
+	record := int64(headerSize + 1)
+	s := open(t, Options{Dir: t.TempDir(), SegmentSize: 1, MaxSize: 3 * record})
+	appendAll(t, s, 0, 10)
+
+	if size := s.Size(); size > 4*record {
+		t.Fatalf("Size = %d, want at most %d", size, 4*record)
+	}
+	if got := s.Len() + int(s.Dropped()); got != 10 {
+		t.Fatalf("Len + Dropped = %d, want 10", got)
+	}
+	// The newest records are kept.
+	records, err := s.Peek(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := string(records[len(records)-1].Data); last != "9" {
+		t.Fatalf("last record = %s, want 9", last)
+	}
+	if first := string(records[0].Data); first == "0" {
+		t.Fatal("oldest record was not dropped")
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	s := open(t, Options{Dir: t.TempDir(), SegmentSize: 1, MaxAge: 50 * time.Millisecond})
+	appendAll(t, s, 0, 2)
+	time.Sleep(100 * time.Millisecond)
+
+	// Old segments are dropped on append, except the last one written to.
+	appendAll(t, s, 2, 3)
+	if s.Dropped() != 1 {
+		t.Fatalf("Dropped = %d, want 1", s.Dropped())
+	}
+	expect(t, s, 10, "1", "2")
+
+	appendAll(t, s, 3, 4)
+	if s.Dropped() != 2 {
+		t.Fatalf("Dropped = %d, want 2", s.Dropped())
+	}
+	expect(t, s, 10, "2", "3")
+}
+
+func header(length uint32, data []byte) []byte {
+	buf := make([]byte, headerSize, headerSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], length)
+	binary.BigEndian.PutUint64(buf[8:16], uint64(time.Now().UnixNano()))
+	return append(buf, data...)
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
@@ -12,6 +12,7 @@ require (
 	github.com/shirou/gopsutil v3.21.11+incompatible
 	github.com/spf13/viper v1.18.2
 	github.com/streadway/amqp v1.1.0
+	go.mongodb.org/mongo-driver v1.13.1
 	go.uber.org/zap v1.26.0
 )
 
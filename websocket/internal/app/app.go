@@ -13,22 +13,58 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+	_ "upbit/internal/exchange/binance"
+	_ "upbit/internal/exchange/bithumb"
+	"upbit/internal/exchange/upbit"
 	v1 "upbit/internal/http/v1"
 	"upbit/internal/metrics"
+	"upbit/internal/registry"
 	"upbit/internal/server"
+	"upbit/internal/store"
+	"upbit/internal/supervisor"
+	"upbit/internal/ws"
 )
 
+const defaultShutdownTimeout = 30 * time.Second
+
 func Run() {
 	cfg, err := config.InitConfig()
 	if err != nil {
-		log.Logger.Error(fmt.Sprintf("Failed to load config: %v", err))
+		log.Logger.Fatal("Failed to load config", zap.Error(err))
 	}
-	log.Logger.Info(fmt.Sprintf("Config FILE --> ", cfg))
+	log.Logger.Info(fmt.Sprintf("Config FILE --> %+v", cfg.HTTP))
+
+	// Load the Upbit market list at startup so the first stream does not wait for it
+	upbit.DefaultCatalog(cfg)
 
 	rabbitConnect := rabbitmq.NewConnectWithRetries(cfg)
-	rabbitProducer, _ := rabbitmq.NewProducer(cfg, rabbitConnect)
+	rabbitConnect.OnRetry = metrics.ObserveReconnect("rabbitmq", "producer")
+	rabbitProducer, err := rabbitmq.NewProducer(cfg, rabbitConnect)
+	if err != nil {
+		log.Logger.Fatal("Failed to start the RabbitMQ producer", zap.Error(err))
+	}
+	metrics.RegisterProducer(rabbitProducer)
+	upbit.DefaultCatalog(cfg).Notify(ws.MarketEvents(rabbitProducer, upbit.Name))
 
-	handler := v1.NewHandler(cfg, rabbitProducer)
+	sup := supervisor.New(supervisor.Options{
+		CrashLoopWindow:   cfg.WebSocket.Supervisor.CrashLoopWindow,
+		CrashLoopRestarts: cfg.WebSocket.Supervisor.CrashLoopRestarts,
+		Restart:           cfg.WebSocket.Supervisor.Restart,
+	})
+	go sup.Run(context.Background())
+
+	st := store.New(context.Background(), cfg)
+	streams := registry.New(cfg, rabbitProducer, sup, st)
+	handler := v1.NewHandler(streams)
+
+	// Start the streams declared in the config and follow changes to them, other
+	// settings only apply after a restart.
+	streams.Reconcile(cfg.Streams)
+	// Bring back the streams started through the control API before the restart.
+	streams.Restore(context.Background())
+	config.Watch(func(reloaded *config.Config) {
+		streams.Reconcile(reloaded.Streams)
+	})
 	srv := server.NewServer(cfg, handler.Routes())
 
 	go func() {
@@ -47,12 +83,34 @@ func Run() {
 
 	<-quit
 
-	const timeout = 5 * time.Second
-
+	timeout := cfg.Shutdown.Timeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
 	ctx, shutdown := context.WithTimeout(context.Background(), timeout)
 	defer shutdown()
 
+	log.Logger.Info(fmt.Sprintf("Shutting down within %s", timeout))
+
+	// Stop taking control calls first so that no stream is started meanwhile.
 	if err := srv.Stop(ctx); err != nil {
 		log.Logger.Error("failed to stop server: %v", zap.Error(err))
 	}
+
+	// Cancel every stream, the managers close their sockets and return, then
+	// the pipelines hand what they queued to the producer.
+	streams.Close(ctx)
+	if err := sup.Wait(ctx); err != nil {
+		log.Logger.Error("Connection managers did not stop in time", zap.Error(err))
+	}
+
+	// The registry no longer writes to the store once its streams are closed.
+	if err := st.Close(ctx); err != nil {
+		log.Logger.Error("Failed to close the stream store", zap.Error(err))
+	}
+
+	if err := rabbitProducer.Shutdown(ctx); err != nil {
+		log.Logger.Error("Failed to shut down the RabbitMQ producer", zap.Error(err))
+	}
+	log.Logger.Info("Shutdown complete")
 }
@@ -0,0 +1,208 @@
+package binance
+
+import (
+	"common/config"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+	"upbit/internal/exchange"
+)
+
+const (
+	Name = "binance"
+
+	defaultWsURL = "wss://stream.binance.com:9443/stream"
+
+	// Binance closes every connection after 24 hours, rotate a bit earlier.
+	maxLifetime = 23*time.Hour + 50*time.Minute
+
+	// A single connection can listen to a maximum of 1024 streams.
+	maxStreams = 1024
+)
+
+var defaultSymbols = []string{"BTCUSDT", "ETHUSDT"}
+
+// streams maps our data types to Binance stream names.
+var streams = map[string][]string{
+	"trade":  {"trade"},
+	"ticker": {"bookTicker", "miniTicker"},
+}
+
+func init() {
+	exchange.Register(Name, New)
+}
+
+type Binance struct {
+	wsURL     string
+	symbols   []string
+	requestID atomic.Int64
+}
+
+func New(cfg *config.Config) (exchange.Exchange, error) {
+	b := &Binance{
+		wsURL:   cfg.Binance.WsURL,
+		symbols: cfg.Binance.Symbols,
+	}
+	if b.wsURL == "" {
+		b.wsURL = defaultWsURL
+	}
+	if len(b.symbols) == 0 {
+		b.symbols = defaultSymbols
+	}
+	return b, nil
+}
+
+func (b *Binance) Name() string {
+	return Name
+}
+
+func (b *Binance) Supports(dataType string) bool {
+	_, ok := streams[dataType]
+	return ok
+}
+
+func (b *Binance) Dial(dataTypes []string) (string, http.Header, error) {
+	return b.wsURL, nil, nil
+}
+
+func (b *Binance) Markets(ctx context.Context, dataType string) ([]string, error) {
+	return b.symbols, nil
+}
+
+func (b *Binance) Subscribe(subs []exchange.Subscription) ([][]byte, error) {
+	var params []string
+	for _, sub := range subs {
+		names, err := streamNames(sub.DataType, sub.Markets)
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, names...)
+	}
+	if len(params) > maxStreams {
+		return nil, fmt.Errorf("binance allows at most %d streams per connection, got %d", maxStreams, len(params))
+	}
+
+	frame, err := b.request("SUBSCRIBE", params)
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{frame}, nil
+}
+
+// Resubscribe unsubscribes the removed streams and subscribes the added ones,
+// SUBSCRIBE on its own only ever adds streams.
+func (b *Binance) Resubscribe(previous, current []exchange.Subscription) ([][]byte, error) {
+	var before, after []string
+	for _, sub := range previous {
+		names, err := streamNames(sub.DataType, sub.Markets)
+		if err != nil {
+			return nil, err
+		}
+		before = append(before, names...)
+	}
+	for _, sub := range current {
+		names, err := streamNames(sub.DataType, sub.Markets)
+		if err != nil {
+			return nil, err
+		}
+		after = append(after, names...)
+	}
+	if len(after) > maxStreams {
+		return nil, fmt.Errorf("binance allows at most %d streams per connection, got %d", maxStreams, len(after))
+	}
+	added, removed := exchange.Diff(before, after)
+
+	var frames [][]byte
+	for _, change := range []struct {
+		method string
+		params []string
+	}{{"UNSUBSCRIBE", removed}, {"SUBSCRIBE", added}} {
+		if len(change.params) == 0 {
+			continue
+		}
+		frame, err := b.request(change.method, change.params)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+func streamNames(dataType string, markets []string) ([]string, error) {
+	names, ok := streams[dataType]
+	if !ok {
+		return nil, fmt.Errorf("binance does not support data type %s", dataType)
+	}
+
+	params := make([]string, 0, len(markets)*len(names))
+	for _, market := range markets {
+		for _, name := range names {
+			params = append(params, strings.ToLower(market)+"@"+name)
+		}
+	}
+	return params, nil
+}
+
+func (b *Binance) request(method string, params []string) ([]byte, error) {
+	request := map[string]interface{}{
+		"method": method,
+		"params": params,
+		"id":     b.requestID.Add(1),
+	}
+	jsonRequest, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create json request to websocket: %v", err)
+	}
+	return jsonRequest, nil
+}
+
+// frame is either a combined stream event or a reply to a SUBSCRIBE request.
+type frame struct {
+	Stream string `json:"stream"`
+	Data   *struct {
+		Symbol string `json:"s"`
+	} `json:"data"`
+	Error *struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	} `json:"error"`
+}
+
+func (b *Binance) Decode(data []byte) ([]exchange.Message, error) {
+	var f frame
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to decode binance frame: %v", err)
+	}
+	if f.Error != nil {
+		return nil, fmt.Errorf("binance error %d: %s", f.Error.Code, f.Error.Msg)
+	}
+	if f.Stream == "" || f.Data == nil {
+		// {"result":null,"id":1} reply to SUBSCRIBE
+		return nil, nil
+	}
+
+	_, name, _ := strings.Cut(f.Stream, "@")
+	for dataType, names := range streams {
+		for _, n := range names {
+			if n == name {
+				return []exchange.Message{{Type: dataType, Market: f.Data.Symbol, Kind: name, Body: data}}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unknown binance stream %q", f.Stream)
+}
+
+// Keepalive is disabled: Binance pings every 20 seconds and the
+// ping handler answers with a matching pong.
+func (b *Binance) Keepalive() (time.Duration, []byte) {
+	return 0, nil
+}
+
+func (b *Binance) MaxLifetime() time.Duration {
+	return maxLifetime
+}
@@ -0,0 +1,199 @@
+package bithumb
+
+import (
+	"common/config"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+	"upbit/internal/exchange"
+)
+
+const (
+	Name = "bithumb"
+
+	defaultWsURL = "wss://pubwss.bithumb.com/pub/ws"
+	statusOK     = "0000"
+)
+
+var (
+	defaultSymbols   = []string{"BTC_KRW", "ETH_KRW"}
+	defaultTickTypes = []string{"30M", "1H", "12H", "24H", "MID"}
+)
+
+// channels maps our data types to Bithumb subscription types.
+var channels = map[string]string{
+	"ticker":    "ticker",
+	"trade":     "transaction",
+	"orderbook": "orderbookdepth",
+}
+
+func init() {
+	exchange.Register(Name, New)
+}
+
+type Bithumb struct {
+	wsURL     string
+	symbols   []string
+	tickTypes []string
+}
+
+func New(cfg *config.Config) (exchange.Exchange, error) {
+	b := &Bithumb{
+		wsURL:     cfg.Bithumb.WsURL,
+		symbols:   cfg.Bithumb.Symbols,
+		tickTypes: cfg.Bithumb.TickTypes,
+	}
+	if b.wsURL == "" {
+		b.wsURL = defaultWsURL
+	}
+	if len(b.symbols) == 0 {
+		b.symbols = defaultSymbols
+	}
+	if len(b.tickTypes) == 0 {
+		b.tickTypes = defaultTickTypes
+	}
+	return b, nil
+}
+
+func (b *Bithumb) Name() string {
+	return Name
+}
+
+func (b *Bithumb) Supports(dataType string) bool {
+	_, ok := channels[dataType]
+	return ok
+}
+
+func (b *Bithumb) Dial(dataTypes []string) (string, http.Header, error) {
+	return b.wsURL, nil, nil
+}
+
+func (b *Bithumb) Markets(ctx context.Context, dataType string) ([]string, error) {
+	return b.symbols, nil
+}
+
+// Subscribe sends one filter per data type, Bithumb keeps every filter
+// registered on the connection.
+func (b *Bithumb) Subscribe(subs []exchange.Subscription) ([][]byte, error) {
+	frames := make([][]byte, 0, len(subs))
+	for _, sub := range subs {
+		channel, ok := channels[sub.DataType]
+		if !ok {
+			return nil, fmt.Errorf("bithumb does not support data type %s", sub.DataType)
+		}
+		request := map[string]interface{}{
+			"type":    channel,
+			"symbols": sub.Markets,
+		}
+		if channel == "ticker" {
+			request["tickTypes"] = b.tickTypes
+		}
+		jsonRequest, err := json.Marshal(request)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create json request to websocket: %v", err)
+		}
+		frames = append(frames, jsonRequest)
+	}
+	return frames, nil
+}
+
+// frame is either a status frame or a data frame.
+type frame struct {
+	Status  string          `json:"status"`
+	ResMsg  string          `json:"resmsg"`
+	Type    string          `json:"type"`
+	Content json.RawMessage `json:"content"`
+}
+
+type listContent struct {
+	List     []json.RawMessage `json:"list"`
+	Datetime json.RawMessage   `json:"datetime,omitempty"`
+}
+
+type symbolOnly struct {
+	Symbol string `json:"symbol"`
+}
+
+// tickerContent is a ticker of one of the subscribed tick types, 30M to 24H or MID.
+type tickerContent struct {
+	Symbol   string `json:"symbol"`
+	TickType string `json:"tickType"`
+}
+
+func (b *Bithumb) Decode(data []byte) ([]exchange.Message, error) {
+	var f frame
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to decode bithumb frame: %v", err)
+	}
+	if f.Status != "" {
+		if f.Status != statusOK {
+			return nil, fmt.Errorf("bithumb status %s: %s", f.Status, f.ResMsg)
+		}
+		// "Connected Successfully" and "Filter Registered Successfully" acks
+		return nil, nil
+	}
+
+	switch f.Type {
+	case "ticker":
+		var t tickerContent
+		if err := json.Unmarshal(f.Content, &t); err != nil {
+			return nil, fmt.Errorf("failed to decode bithumb ticker: %v", err)
+		}
+		return []exchange.Message{{Type: "ticker", Market: t.Symbol, Kind: t.TickType, Body: data}}, nil
+	case "transaction":
+		return splitBySymbol("trade", f, data)
+	case "orderbookdepth":
+		return splitBySymbol("orderbook", f, data)
+	default:
+		return nil, fmt.Errorf("unknown bithumb message type %q", f.Type)
+	}
+}
+
+// splitBySymbol splits a list frame that may carry several symbols into one
+// message per symbol, each keeping Bithumb's original frame layout.
+func splitBySymbol(dataType string, f frame, data []byte) ([]exchange.Message, error) {
+	var content listContent
+	if err := json.Unmarshal(f.Content, &content); err != nil {
+		return nil, fmt.Errorf("failed to decode bithumb %s: %v", f.Type, err)
+	}
+
+	var order []string
+	bySymbol := make(map[string][]json.RawMessage)
+	for _, item := range content.List {
+		var s symbolOnly
+		if err := json.Unmarshal(item, &s); err != nil {
+			return nil, fmt.Errorf("failed to decode bithumb %s item: %v", f.Type, err)
+		}
+		if _, ok := bySymbol[s.Symbol]; !ok {
+			order = append(order, s.Symbol)
+		}
+		bySymbol[s.Symbol] = append(bySymbol[s.Symbol], item)
+	}
+
+	if len(order) == 1 {
+		return []exchange.Message{{Type: dataType, Market: order[0], Body: data}}, nil
+	}
+
+	msgs := make([]exchange.Message, 0, len(order))
+	for _, symbol := range order {
+		body, err := json.Marshal(struct {
+			Type    string      `json:"type"`
+			Content listContent `json:"content"`
+		}{
+			Type:    f.Type,
+			Content: listContent{List: bySymbol[symbol], Datetime: content.Datetime},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode bithumb %s: %v", f.Type, err)
+		}
+		msgs = append(msgs, exchange.Message{Type: dataType, Market: symbol, Body: body})
+	}
+	return msgs, nil
+}
+
+// Keepalive is disabled, WebSocket pings keep Bithumb connections open.
+func (b *Bithumb) Keepalive() (time.Duration, []byte) {
+	return 0, nil
+}
@@ -0,0 +1,163 @@
+package exchange
+
+import (
+	"common/config"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"upbit/internal/orderbook"
+)
+
+// ErrUnknownExchange is returned by New for platforms that have no registered adapter.
+var ErrUnknownExchange = errors.New("unknown exchange")
+
+// Exchange adapts a venue's WebSocket API to the connection manager.
+type Exchange interface {
+	// Name returns the platform name used in the control API.
+	Name() string
+	// Supports reports whether the venue can stream the given data type.
+	Supports(dataType string) bool
+	// Dial returns the WebSocket endpoint and the handshake headers of a
+	// connection carrying the given data types.
+	Dial(dataTypes []string) (string, http.Header, error)
+	// Markets returns the markets a stream of dataType subscribes to.
+	Markets(ctx context.Context, dataType string) ([]string, error)
+	// Subscribe builds the frames that subscribe a connection to all subscriptions.
+	Subscribe(subs []Subscription) ([][]byte, error)
+	// Decode turns an inbound frame into messages to publish.
+	// Control frames such as acks and pongs yield no messages.
+	Decode(frame []byte) ([]Message, error)
+	// Keepalive returns how often an application level keepalive has to be sent
+	// and the text frame to send, on top of the WebSocket pings every connection
+	// sends. A zero interval means the venue needs none.
+	Keepalive() (time.Duration, []byte)
+}
+
+// Resubscriber is implemented by adapters that can change the markets of a live
+// subscription. Other adapters get reconnected to apply a new market list.
+type Resubscriber interface {
+	Resubscribe(previous, current []Subscription) ([][]byte, error)
+}
+
+// Lister is implemented by adapters that know every market the venue lists,
+// including those outside the default market list of a stream.
+type Lister interface {
+	// Unlisted returns the markets the venue does not list.
+	Unlisted(ctx context.Context, markets []string) ([]string, error)
+}
+
+// Multiplexer is implemented by adapters that restrict which data types can
+// share a single connection.
+type Multiplexer interface {
+	Multiplex(dataTypes []string) error
+}
+
+// Lifetime is implemented by adapters whose venue drops connections after a fixed period.
+// The connection manager reconnects before MaxLifetime elapses.
+type Lifetime interface {
+	MaxLifetime() time.Duration
+}
+
+// Subscription is the set of markets subscribed for one data type.
+type Subscription struct {
+	DataType string   `json:"dataType"`
+	Markets  []string `json:"markets"`
+}
+
+// Message is a decoded market data message.
+type Message struct {
+	Type   string
+	Market string
+	// Kind tells apart payloads of one data type and market that do not
+	// supersede each other, such as Binance bookTicker and miniTicker.
+	Kind string
+	Body []byte
+	// Account identifies the account of private messages.
+	Account string
+	// Book is set for order book messages that carry a full snapshot.
+	Book *orderbook.Snapshot
+}
+
+// Factory creates an adapter from the application config.
+type Factory func(cfg *config.Config) (Exchange, error)
+
+var (
+	mu        sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes an adapter available under the given platform name.
+// It panics if the name is registered twice.
+func Register(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if factory == nil {
+		panic("exchange: Register factory is nil")
+	}
+	if _, dup := factories[name]; dup {
+		panic("exchange: Register called twice for " + name)
+	}
+	factories[name] = factory
+}
+
+// New creates the adapter registered under the given platform name.
+func New(name string, cfg *config.Config) (Exchange, error) {
+	mu.RLock()
+	factory, ok := factories[name]
+	mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownExchange, name)
+	}
+	return factory(cfg)
+}
+
+// Names returns the registered platform names in sorted order.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Find returns the markets subscribed for dataType.
+func Find(subs []Subscription, dataType string) []string {
+	for _, sub := range subs {
+		if sub.DataType == dataType {
+			return sub.Markets
+		}
+	}
+	return nil
+}
+
+// Diff returns the markets of current missing from previous and the markets of
+// previous missing from current.
+func Diff(previous, current []string) (added, removed []string) {
+	had := make(map[string]bool, len(previous))
+	for _, market := range previous {
+		had[market] = true
+	}
+	has := make(map[string]bool, len(current))
+	for _, market := range current {
+		has[market] = true
+		if !had[market] {
+			added = append(added, market)
+		}
+	}
+	for _, market := range previous {
+		if !has[market] {
+			removed = append(removed, market)
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,223 @@
+package upbit
+
+import (
+	"common/pkg/log"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"upbit/internal/exchange"
+)
+
+const (
+	defaultRestURL       = "https://api.upbit.com"
+	defaultRefreshPeriod = 10 * time.Minute
+)
+
+var defaultQuotes = []string{"KRW"}
+
+// Market is an entry of GET /v1/market/all?isDetails=true.
+type Market struct {
+	Market        string `json:"market"`
+	KoreanName    string `json:"korean_name"`
+	EnglishName   string `json:"english_name"`
+	MarketWarning string `json:"market_warning"`
+}
+
+// Quote returns the quote currency of the market, KRW for KRW-BTC.
+func (m Market) Quote() string {
+	quote, _, _ := strings.Cut(m.Market, "-")
+	return quote
+}
+
+// Catalog keeps the list of markets listed on Upbit for the configured quote currencies.
+type Catalog struct {
+	restURL string
+	quotes  map[string]bool
+	period  time.Duration
+	client  *http.Client
+
+	mu      sync.RWMutex
+	markets []Market
+	// known holds the codes of every market, whatever its quote currency.
+	known     map[string]bool
+	fetchedAt time.Time
+	onChange  func(listed, delisted []string)
+}
+
+func NewCatalog(restURL string, quotes []string, period time.Duration, client *http.Client) *Catalog {
+	if restURL == "" {
+		restURL = defaultRestURL
+	}
+	if len(quotes) == 0 {
+		quotes = defaultQuotes
+	}
+	if period <= 0 {
+		period = defaultRefreshPeriod
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	c := &Catalog{
+		restURL: strings.TrimSuffix(restURL, "/"),
+		quotes:  make(map[string]bool, len(quotes)),
+		period:  period,
+		client:  client,
+	}
+	for _, quote := range quotes {
+		c.quotes[strings.ToUpper(quote)] = true
+	}
+	return c
+}
+
+// Run refreshes the catalog right away and then on every period until ctx is done.
+func (c *Catalog) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.period)
+	defer ticker.Stop()
+
+	for {
+		if err := c.Refresh(ctx); err != nil {
+			log.Logger.Error("Failed to refresh upbit market catalog", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Notify registers fn to be called after every refresh that lists or delists
+// markets, with the changed market codes.
+func (c *Catalog) Notify(fn func(listed, delisted []string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onChange = fn
+}
+
+// Refresh fetches the market list and replaces the cached one. Changes to a
+// previously loaded list are reported to the Notify listener.
+func (c *Catalog) Refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.restURL+"/v1/market/all?isDetails=true", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch upbit markets: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch upbit markets: unexpected status %s", resp.Status)
+	}
+
+	var all []Market
+	if err := json.NewDecoder(resp.Body).Decode(&all); err != nil {
+		return fmt.Errorf("failed to decode upbit markets: %v", err)
+	}
+
+	markets := make([]Market, 0, len(all))
+	known := make(map[string]bool, len(all))
+	for _, m := range all {
+		known[m.Market] = true
+		if c.quotes[m.Quote()] {
+			markets = append(markets, m)
+		}
+	}
+	sort.Slice(markets, func(i, j int) bool { return markets[i].Market < markets[j].Market })
+
+	c.mu.Lock()
+	var listed, delisted []string
+	if !c.fetchedAt.IsZero() {
+		listed, delisted = exchange.Diff(codes(c.markets), codes(markets))
+	}
+	c.markets = markets
+	c.known = known
+	c.fetchedAt = time.Now()
+	onChange := c.onChange
+	c.mu.Unlock()
+
+	log.Logger.Info(fmt.Sprintf("Upbit market catalog refreshed: %d markets", len(markets)))
+	if onChange != nil && (len(listed) > 0 || len(delisted) > 0) {
+		onChange(listed, delisted)
+	}
+	return nil
+}
+
+// Markets returns the sorted market codes, fetching them first if the catalog was never loaded.
+func (c *Catalog) Markets(ctx context.Context) ([]string, error) {
+	if err := c.load(ctx); err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return codes(c.markets), nil
+}
+
+// Unlisted returns the markets Upbit does not list in any quote currency,
+// fetching the catalog first if it was never loaded.
+func (c *Catalog) Unlisted(ctx context.Context, markets []string) ([]string, error) {
+	if err := c.load(ctx); err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var unlisted []string
+	for _, market := range markets {
+		if !c.known[market] {
+			unlisted = append(unlisted, market)
+		}
+	}
+	return unlisted, nil
+}
+
+// load fetches the market list unless it was loaded before.
+func (c *Catalog) load(ctx context.Context) error {
+	c.mu.RLock()
+	loaded := !c.fetchedAt.IsZero()
+	c.mu.RUnlock()
+
+	if loaded {
+		return nil
+	}
+	return c.Refresh(ctx)
+}
+
+func codes(markets []Market) []string {
+	codes := make([]string, len(markets))
+	for i, m := range markets {
+		codes[i] = m.Market
+	}
+	return codes
+}
+
+// Details returns the cached markets with their names and warnings.
+func (c *Catalog) Details() []Market {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return append([]Market(nil), c.markets...)
+}
+
+// FetchedAt returns when the catalog was last refreshed.
+func (c *Catalog) FetchedAt() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.fetchedAt
+}
@@ -0,0 +1,196 @@
+package upbit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeUpbit serves GET /v1/market/all from a market list that tests can change.
+type fakeUpbit struct {
+	mu      sync.Mutex
+	markets []Market
+	status  int
+	calls   atomic.Int32
+}
+
+func (f *fakeUpbit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.calls.Add(1)
+	if r.URL.Path != "/v1/market/all" || r.URL.Query().Get("isDetails") != "true" {
+		http.NotFound(w, r)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.status != 0 {
+		http.Error(w, "unavailable", f.status)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(f.markets)
+}
+
+func (f *fakeUpbit) set(markets ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.markets = nil
+	for _, m := range markets {
+		f.markets = append(f.markets, Market{Market: m, EnglishName: m})
+	}
+}
+
+func newCatalog(t *testing.T, quotes ...string) (*Catalog, *fakeUpbit) {
+	t.Helper()
+	fake := &fakeUpbit{}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	return NewCatalog(srv.URL+"/", quotes, time.Hour, srv.Client()), fake
+}
+
+func TestCatalogFiltersQuotes(t *testing.T) {
+	tests := []struct {
+		name   string
+		quotes []string
+		want   []string
+	}{
+		{name: "KRW by default", want: []string{"KRW-BTC", "KRW-ETH"}},
+		{name: "configured quotes", quotes: []string{"btc", "USDT"}, want: []string{"BTC-ETH", "USDT-BTC"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, fake := newCatalog(t, tt.quotes...)
+			fake.set("KRW-ETH", "BTC-ETH", "USDT-BTC", "KRW-BTC")
+
+			if err := c.Refresh(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.Markets(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Markets = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCatalogRefreshFails(t *testing.T) {
+	c, fake := newCatalog(t)
+	fake.set("KRW-BTC")
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.mu.Lock()
+	fake.status = http.StatusTooManyRequests
+	fake.mu.Unlock()
+	if err := c.Refresh(context.Background()); err == nil {
+		t.Fatal("Refresh succeeded on a 429")
+	}
+
+	// A failed refresh keeps the last list.
+	got, err := c.Markets(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []string{"KRW-BTC"}) {
+		t.Fatalf("Markets = %v after a failed refresh, want [KRW-BTC]", got)
+	}
+}
+
+func TestCatalogMarketsLoadsLazily(t *testing.T) {
+	c, fake := newCatalog(t)
+	fake.set("KRW-BTC")
+
+	if !c.FetchedAt().IsZero() {
+		t.Fatal("catalog was loaded before use")
+	}
+	got, err := c.Markets(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []string{"KRW-BTC"}) {
+		t.Fatalf("Markets = %v, want [KRW-BTC]", got)
+	}
+	if fake.calls.Load() != 1 {
+		t.Fatalf("%d requests, want 1", fake.calls.Load())
+	}
+
+	// Loaded once, later calls are served from the cache until the next refresh.
+	fake.set("KRW-BTC", "KRW-ETH")
+	if _, err := c.Markets(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if fake.calls.Load() != 1 {
+		t.Fatalf("%d requests, want 1", fake.calls.Load())
+	}
+}
+
+func TestCatalogMarketsFailsWithoutList(t *testing.T) {
+	c, fake := newCatalog(t)
+	fake.status = http.StatusInternalServerError
+
+	if _, err := c.Markets(context.Background()); err == nil {
+		t.Fatal("Markets succeeded without a market list")
+	}
+	if !c.FetchedAt().IsZero() {
+		t.Fatal("failed load was recorded as fetched")
+	}
+}
+
+func TestCatalogNotifiesChanges(t *testing.T) {
+	c, fake := newCatalog(t)
+	var listed, delisted []string
+	calls := 0
+	c.Notify(func(l, d []string) {
+		calls++
+		listed, delisted = l, d
+	})
+
+	// The first load announces nothing.
+	fake.set("KRW-BTC", "KRW-ETH")
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 0 {
+		t.Fatalf("first load notified %v and %v", listed, delisted)
+	}
+
+	fake.set("KRW-BTC", "KRW-XRP")
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 || !reflect.DeepEqual(listed, []string{"KRW-XRP"}) || !reflect.DeepEqual(delisted, []string{"KRW-ETH"}) {
+		t.Fatalf("notified %d times with %v and %v, want once with [KRW-XRP] and [KRW-ETH]", calls, listed, delisted)
+	}
+
+	// An unchanged list is not announced.
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("unchanged list notified %v and %v", listed, delisted)
+	}
+}
+
+func TestCatalogUnlisted(t *testing.T) {
+	c, fake := newCatalog(t)
+	fake.set("KRW-BTC", "BTC-ETH")
+
+	// Markets of other quote currencies are listed, though not streamed by default.
+	got, err := c.Unlisted(context.Background(), []string{"KRW-BTC", "BTC-ETH", "KRW-NOPE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []string{"KRW-NOPE"}) {
+		t.Fatalf("Unlisted = %v, want [KRW-NOPE]", got)
+	}
+}
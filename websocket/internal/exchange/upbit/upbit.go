@@ -0,0 +1,252 @@
+package upbit
+
+import (
+	"common/config"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"upbit/internal/domain"
+	"upbit/internal/exchange"
+	"upbit/internal/orderbook"
+	"upbit/internal/ws/token"
+)
+
+const Name = "upbit"
+
+// privateTypes are the account channels that require an authenticated connection.
+var privateTypes = map[string]bool{
+	"myOrder": true,
+	"myAsset": true,
+}
+
+// Upbit closes connections that stay silent for 120 seconds and answers
+// a text PING with {"status":"UP"}.
+const keepaliveInterval = 60 * time.Second
+
+func init() {
+	exchange.Register(Name, New)
+}
+
+var (
+	catalogOnce   sync.Once
+	sharedCatalog *Catalog
+)
+
+// DefaultCatalog returns the process wide market catalog, creating it and
+// starting its refresh loop on first use.
+func DefaultCatalog(cfg *config.Config) *Catalog {
+	catalogOnce.Do(func() {
+		sharedCatalog = NewCatalog(cfg.UpBit.RestURL, cfg.UpBit.Quotes, cfg.UpBit.MarketRefresh, nil)
+		go sharedCatalog.Run(context.Background())
+	})
+	return sharedCatalog
+}
+
+type Upbit struct {
+	catalog        *Catalog
+	wsURL          string
+	privateWsURL   string
+	account        string
+	token          domain.Token
+	orderbookUnits int
+}
+
+func New(cfg *config.Config) (exchange.Exchange, error) {
+	if cfg.UpBit.WsURL == "" {
+		return nil, fmt.Errorf("upbit websocket url is not configured")
+	}
+	u := &Upbit{
+		catalog:      DefaultCatalog(cfg),
+		wsURL:        cfg.UpBit.WsURL,
+		privateWsURL: cfg.UpBit.PrivateWsURL,
+		account:      cfg.UpBit.Account,
+		token: domain.Token{
+			AccessKey: cfg.UpBit.AccessKey,
+			SecretKey: cfg.UpBit.SecretKey,
+		},
+		orderbookUnits: cfg.UpBit.OrderbookUnits,
+	}
+	if u.privateWsURL == "" {
+		u.privateWsURL = u.wsURL
+	}
+	if u.account == "" && u.token.AccessKey != "" {
+		// The access key is a credential, messages only carry a digest of it.
+		sum := sha256.Sum256([]byte(u.token.AccessKey))
+		u.account = "key-" + hex.EncodeToString(sum[:4])
+	}
+	return u, nil
+}
+
+func (u *Upbit) Name() string {
+	return Name
+}
+
+func (u *Upbit) Supports(dataType string) bool {
+	switch dataType {
+	case "ticker", "trade", "orderbook":
+		return true
+	case "myOrder", "myAsset":
+		// Private channels are only available with API keys.
+		return u.token.AccessKey != "" && u.token.SecretKey != ""
+	default:
+		return false
+	}
+}
+
+func (u *Upbit) Dial(dataTypes []string) (string, http.Header, error) {
+	jwtToken, err := token.CreateToken(u.token)
+	if err != nil {
+		return "", nil, err
+	}
+	header := http.Header{}
+	header.Add("Authorization", "Bearer "+jwtToken)
+	for _, dataType := range dataTypes {
+		if privateTypes[dataType] {
+			return u.privateWsURL, header, nil
+		}
+	}
+	return u.wsURL, header, nil
+}
+
+// Multiplex rejects mixing private and public channels when they are served
+// by different endpoints.
+func (u *Upbit) Multiplex(dataTypes []string) error {
+	if u.privateWsURL == u.wsURL {
+		return nil
+	}
+	var private, public bool
+	for _, dataType := range dataTypes {
+		if privateTypes[dataType] {
+			private = true
+		} else {
+			public = true
+		}
+	}
+	if private && public {
+		return fmt.Errorf("upbit private and public data types use different endpoints")
+	}
+	return nil
+}
+
+func (u *Upbit) Markets(ctx context.Context, dataType string) ([]string, error) {
+	if privateTypes[dataType] {
+		// Private channels follow the account, not a market list.
+		return nil, nil
+	}
+	return u.catalog.Markets(ctx)
+}
+
+// Unlisted returns the markets missing from the Upbit market catalog.
+func (u *Upbit) Unlisted(ctx context.Context, markets []string) ([]string, error) {
+	return u.catalog.Unlisted(ctx, markets)
+}
+
+// Subscribe builds a single request, Upbit accepts several type objects per ticket.
+func (u *Upbit) Subscribe(subs []exchange.Subscription) ([][]byte, error) {
+	request := []map[string]interface{}{
+		{"ticket": uuid.New().String()},
+	}
+	for _, sub := range subs {
+		request = append(request, u.typeField(sub))
+	}
+	request = append(request, map[string]interface{}{"format": "SIMPLE"})
+
+	jsonRequest, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create json request to websocket: %v", err)
+	}
+	return [][]byte{jsonRequest}, nil
+}
+
+func (u *Upbit) typeField(sub exchange.Subscription) map[string]interface{} {
+	if privateTypes[sub.DataType] {
+		// Without codes the private channels stream every market of the account.
+		return map[string]interface{}{"type": sub.DataType}
+	}
+	codes := sub.Markets
+	if sub.DataType == "orderbook" && u.orderbookUnits > 0 {
+		// KRW-BTC.5 subscribes to the best 5 units of each side.
+		units := "." + strconv.Itoa(u.orderbookUnits)
+		codes = make([]string, len(sub.Markets))
+		for i, market := range sub.Markets {
+			codes[i] = market + units
+		}
+	}
+	return map[string]interface{}{"type": sub.DataType, "isOnlyRealtime": true, "codes": codes}
+}
+
+// Resubscribe sends a new ticket, Upbit replaces the previous subscription with it.
+func (u *Upbit) Resubscribe(previous, current []exchange.Subscription) ([][]byte, error) {
+	return u.Subscribe(current)
+}
+
+// frame covers the SIMPLE format fields and the status and error replies.
+type frame struct {
+	Type      string      `json:"ty"`
+	Code      string      `json:"cd"`
+	Timestamp int64       `json:"tms"`
+	Units     []orderUnit `json:"obu"`
+	Status    string      `json:"status"`
+	Error     *struct {
+		Name    string `json:"name"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (u *Upbit) Decode(data []byte) ([]exchange.Message, error) {
+	var f frame
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to decode upbit frame: %v", err)
+	}
+	if f.Error != nil {
+		return nil, fmt.Errorf("upbit error %s: %s", f.Error.Name, f.Error.Message)
+	}
+	if f.Type == "" {
+		// {"status":"UP"} reply to PING
+		return nil, nil
+	}
+	msg := exchange.Message{Type: f.Type, Market: f.Code, Body: data}
+	if f.Type == "orderbook" {
+		msg.Book = f.snapshot()
+	}
+	if privateTypes[f.Type] {
+		msg.Account = u.account
+	}
+	return []exchange.Message{msg}, nil
+}
+
+type orderUnit struct {
+	AskPrice float64 `json:"ap"`
+	BidPrice float64 `json:"bp"`
+	AskSize  float64 `json:"as"`
+	BidSize  float64 `json:"bs"`
+}
+
+func (f *frame) snapshot() *orderbook.Snapshot {
+	s := &orderbook.Snapshot{
+		Market:    f.Code,
+		Timestamp: f.Timestamp,
+		Bids:      make([]orderbook.Level, 0, len(f.Units)),
+		Asks:      make([]orderbook.Level, 0, len(f.Units)),
+	}
+	for _, u := range f.Units {
+		if u.BidSize > 0 {
+			s.Bids = append(s.Bids, orderbook.Level{Price: u.BidPrice, Size: u.BidSize})
+		}
+		if u.AskSize > 0 {
+			s.Asks = append(s.Asks, orderbook.Level{Price: u.AskPrice, Size: u.AskSize})
+		}
+	}
+	return s
+}
+
+func (u *Upbit) Keepalive() (time.Duration, []byte) {
+	return keepaliveInterval, []byte("PING")
+}
@@ -1,102 +1,235 @@
 package v1
 
 import (
-	"common/config"
 	"common/pkg/log"
-	"common/pkg/rabbitmq"
-	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"net/http"
-	"upbit/internal/domain"
+	"strconv"
+	"strings"
+	"time"
+	"upbit/internal/exchange"
+	"upbit/internal/registry"
 	"upbit/internal/ws"
 )
 
 type Handler struct {
-	cmMap          map[string]map[string]*HandlerEntry
-	cm             *config.Config
-	rabbitProducer *rabbitmq.Producer
+	registry *registry.Registry
 }
 
-type HandlerEntry struct {
-	ws     *ws.ConnectionManager
-	cancel context.CancelFunc
-}
-
-func NewHandler(config *config.Config, rabbitProducer *rabbitmq.Producer) *Handler {
+func NewHandler(registry *registry.Registry) *Handler {
 	return &Handler{
-		cmMap:          make(map[string]map[string]*HandlerEntry),
-		cm:             config,
-		rabbitProducer: rabbitProducer,
+		registry: registry,
 	}
 }
 
+// dataTypes parses the dataType URL parameter. Several data types separated by
+// commas share one multiplexed connection, "trade,ticker" and "ticker,trade"
+// name the same stream.
+func dataTypes(r *http.Request) ([]string, string) {
+	types := registry.DataTypes(strings.Split(chi.URLParam(r, "dataType"), ","))
+	return types, strings.Join(types, ",")
+}
+
 func (h *Handler) startHandler(w http.ResponseWriter, r *http.Request) {
-	var (
-		UpBitToken = domain.Token{
-			AccessKey: h.cm.UpBit.AccessKey,
-			SecretKey: h.cm.UpBit.SecretKey,
-		}
-	)
 	platform := chi.URLParam(r, "platform")
-	dataType := chi.URLParam(r, "dataType")
+	types, dataType := dataTypes(r)
 	log.Logger.Info(fmt.Sprintf("Starting connection manager for %s with dataType %s", platform, dataType))
-	restartChan := make(chan string, 10)
 
-	if h.cmMap[platform] == nil {
-		h.cmMap[platform] = make(map[string]*HandlerEntry)
+	var err error
+	opts := h.registry.DefaultOptions()
+	if raw := r.URL.Query().Get("shardSize"); raw != "" {
+		if opts.ShardSize, err = strconv.Atoi(raw); err != nil || opts.ShardSize < 0 {
+			http.Error(w, "shardSize must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if raw := r.URL.Query().Get("idleTimeout"); raw != "" {
+		if opts.IdleTimeout, err = time.ParseDuration(raw); err != nil || opts.IdleTimeout < 0 {
+			http.Error(w, "idleTimeout must be a duration like 90s", http.StatusBadRequest)
+			return
+		}
+	}
+
+	opts.StartedBy = r.Header.Get("X-Started-By")
+	if opts.StartedBy == "" {
+		opts.StartedBy = r.RemoteAddr
 	}
 
-	if _, ok := h.cmMap[platform][dataType]; ok {
+	_, started, err := h.registry.Start(platform, types, opts)
+	if err != nil {
+		log.Logger.Info(fmt.Sprintf("Failed to start %s %s: %v", platform, dataType, err))
+		switch {
+		case errors.Is(err, exchange.ErrUnknownExchange):
+			http.Error(w, fmt.Sprintf("Platform %s is not supported", platform), http.StatusNotFound)
+		case errors.Is(err, registry.ErrUnsupported):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, registry.ErrConflict):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, registry.ErrInvalid):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, registry.ErrClosed):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		default:
+			http.Error(w, fmt.Sprintf("Failed to create exchange adapter for %s", platform), http.StatusInternalServerError)
+		}
+		return
+	}
+	if !started {
 		log.Logger.Info(fmt.Sprintf("Connection manager for platform %s and dataType %s is already started", platform, dataType))
 		fmt.Fprintf(w, "Connection manager for platform %s and dataType %s is already started", platform, dataType)
 		return
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	connManager := ws.NewConnectionManager(ctx, h.cm.UpBit.WsURL, platform, h.cm, h.rabbitProducer)
-
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Logger.Info(fmt.Sprintf("Recovered in startManager for %s: %v", platform, r))
-			}
-		}()
-		connManager.StartManager(ctx, h.cm.UpBit.WsURL, UpBitToken, platform, dataType, restartChan)
-	}()
-
-	h.cmMap[platform][dataType] = &HandlerEntry{
-		ws:     connManager,
-		cancel: cancel,
-	}
-
 	log.Logger.Info(fmt.Sprintf("Connection manager for platform %s with dataType %s started successfully", platform, dataType))
 	fmt.Fprintf(w, "Connection manager for platform %s with dataType %s started successfully", platform, dataType)
 }
 
 func (h *Handler) stopHandler(w http.ResponseWriter, r *http.Request) {
 	platform := chi.URLParam(r, "platform")
-	dataType := chi.URLParam(r, "dataType")
-
-	if dataTypeMap, ok := h.cmMap[platform]; ok {
-		if entry, ok := dataTypeMap[dataType]; ok {
-			entry.cancel()
-			delete(dataTypeMap, dataType)
-			log.Logger.Info(fmt.Sprintf("Connection manager for platform %s with dataType %s stopped successfully", platform, dataType))
-			fmt.Fprintf(w, "Connection manager for platform %s with dataType %s stopped successfully", platform, dataType)
-			return
-		}
+	_, dataType := dataTypes(r)
+
+	if h.registry.Stop(r.Context(), platform, dataType) {
+		log.Logger.Info(fmt.Sprintf("Connection manager for platform %s with dataType %s stopped successfully", platform, dataType))
+		fmt.Fprintf(w, "Connection manager for platform %s with dataType %s stopped successfully", platform, dataType)
+		return
 	}
 
 	log.Logger.Info(fmt.Sprintf("Connection manager for platform %s with dataType %s not found or already stopped", platform, dataType))
 	fmt.Fprintf(w, "Connection manager for platform %s with dataType %s not found or already stopped", platform, dataType)
 }
 
+type marketsRequest struct {
+	Markets []string `json:"markets"`
+}
+
+type marketsResponse struct {
+	Platform      string                  `json:"platform"`
+	DataType      string                  `json:"dataType"`
+	Subscriptions []exchange.Subscription `json:"subscriptions"`
+}
+
+func (h *Handler) stream(w http.ResponseWriter, r *http.Request) (*ws.Stream, bool) {
+	platform := chi.URLParam(r, "platform")
+	_, dataType := dataTypes(r)
+
+	if stream, ok := h.registry.Get(platform, dataType); ok {
+		return stream, true
+	}
+	http.Error(w, fmt.Sprintf("Connection manager for platform %s with dataType %s not found", platform, dataType), http.StatusNotFound)
+	return nil, false
+}
+
+func (h *Handler) marketsHandler(w http.ResponseWriter, r *http.Request) {
+	stream, ok := h.stream(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(marketsResponse{
+		Platform:      stream.Platform,
+		DataType:      stream.DataType(),
+		Subscriptions: stream.Markets(),
+	}); err != nil {
+		log.Logger.Error(fmt.Sprintf("Failed to write markets response: %v", err))
+	}
+}
+
+func (h *Handler) shardsHandler(w http.ResponseWriter, r *http.Request) {
+	stream, ok := h.stream(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stream.Health()); err != nil {
+		log.Logger.Error(fmt.Sprintf("Failed to write shards response: %v", err))
+	}
+}
+
+func (h *Handler) streamsHandler(w http.ResponseWriter, r *http.Request) {
+	statuses := []ws.StreamStatus{}
+	for _, stream := range h.registry.List() {
+		statuses = append(statuses, stream.Status())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		log.Logger.Error(fmt.Sprintf("Failed to write streams response: %v", err))
+	}
+}
+
+func (h *Handler) streamHandler(w http.ResponseWriter, r *http.Request) {
+	stream, ok := h.stream(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stream.Status()); err != nil {
+		log.Logger.Error(fmt.Sprintf("Failed to write stream response: %v", err))
+	}
+}
+
+func (h *Handler) addMarketsHandler(w http.ResponseWriter, r *http.Request) {
+	h.changeMarkets(w, r, true)
+}
+
+func (h *Handler) removeMarketsHandler(w http.ResponseWriter, r *http.Request) {
+	h.changeMarkets(w, r, false)
+}
+
+func (h *Handler) changeMarkets(w http.ResponseWriter, r *http.Request, add bool) {
+	stream, ok := h.stream(w, r)
+	if !ok {
+		return
+	}
+
+	var req marketsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Markets) == 0 {
+		http.Error(w, `Request body must be {"markets": ["KRW-BTC", ...]}`, http.StatusBadRequest)
+		return
+	}
+
+	platform := stream.Platform
+	dataType := stream.DataType()
+	change := h.registry.RemoveMarkets
+	if add {
+		change = h.registry.AddMarkets
+	}
+	if err := change(r.Context(), stream, req.Markets); err != nil {
+		log.Logger.Info(fmt.Sprintf("Failed to change the markets of %s %s: %v", platform, dataType, err))
+		switch {
+		case errors.Is(err, ws.ErrNoMarkets):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, ws.ErrUnlisted):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		}
+		return
+	}
+	if add {
+		log.Logger.Info(fmt.Sprintf("Adding markets %v to %s %s", req.Markets, platform, dataType))
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "Markets %v are being added to platform %s with dataType %s", req.Markets, platform, dataType)
+		return
+	}
+	log.Logger.Info(fmt.Sprintf("Removing markets %v from %s %s", req.Markets, platform, dataType))
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Markets %v are being removed from platform %s with dataType %s", req.Markets, platform, dataType)
+}
+
 func (h *Handler) Routes() *chi.Mux {
 	router := chi.NewRouter()
 	router.Get("/start/{platform}/{dataType}", h.startHandler)
 	router.Get("/stop/{platform}/{dataType}", h.stopHandler)
+	router.Get("/streams", h.streamsHandler)
+	router.Get("/streams/{platform}/{dataType}", h.streamHandler)
+	router.Get("/streams/{platform}/{dataType}/markets", h.marketsHandler)
+	router.Post("/streams/{platform}/{dataType}/markets", h.addMarketsHandler)
+	router.Delete("/streams/{platform}/{dataType}/markets", h.removeMarketsHandler)
+	router.Get("/streams/{platform}/{dataType}/shards", h.shardsHandler)
 	router.Handle("/metrics", promhttp.Handler())
 	return router
 }
@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"common/pkg/rabbitmq"
 	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/shirou/gopsutil/cpu"
@@ -33,10 +34,101 @@ var (
 		Name: "rabbitmq_connection_status",
 		Help: "Current RabbitMQ connection status (1: connected, 0: disconnected)",
 	})
+	ShardConnected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "websocket_shard_connection_status",
+		Help: "Current WebSocket connection status of a stream shard (1: connected, 0: disconnected)",
+	}, []string{"platform", "data_type", "shard"})
+	ShardStale = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "websocket_shard_stale",
+		Help: "Whether a stream shard was dropped for receiving no data (1: stale, 0: fresh)",
+	}, []string{"platform", "data_type", "shard"})
+	SupervisorRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "supervisor_restarts_total",
+		Help: "Number of connection manager restarts by the supervisor",
+	}, []string{"target", "reason"})
+	SupervisorCrashLooping = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "supervisor_crash_looping",
+		Help: "Whether a connection manager restarts too often (1: crash looping, 0: healthy)",
+	}, []string{"target"})
+	PipelineDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "websocket_pipeline_queue_depth",
+		Help: "Messages read from a stream and waiting for a publisher worker",
+	}, []string{"platform", "data_type"})
+	PipelineDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_pipeline_dropped_messages_total",
+		Help: "Messages dropped by the overflow policy of a stream pipeline",
+	}, []string{"platform", "data_type", "reason"})
+	reconnectAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "reconnect_attempts_total",
+		Help: "Number of reconnect attempts",
+	}, []string{"component", "target"})
+	reconnectDelay = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "reconnect_delay_seconds",
+		Help:    "Delay waited before a reconnect attempt",
+		Buckets: prometheus.ExponentialBuckets(0.25, 2, 10),
+	}, []string{"component", "target"})
 )
 
 func init() {
 	prometheus.MustRegister(cpuUsageGauge, diskUsageGauge, ramUsageGauge, webSocketConnectionGauge, rabbitMQConnectionGauge)
+	prometheus.MustRegister(ShardConnected, ShardStale, reconnectAttempts, reconnectDelay)
+	prometheus.MustRegister(SupervisorRestarts, SupervisorCrashLooping)
+	prometheus.MustRegister(PipelineDepth, PipelineDropped)
+}
+
+// RegisterProducer exports the state of the RabbitMQ producer.
+func RegisterProducer(p *rabbitmq.Producer) {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "rabbitmq_producer_connected",
+			Help: "Whether the producer publishes right away (1) or buffers during an outage (0)",
+		}, func() float64 {
+			if p.Connected() {
+				return 1
+			}
+			return 0
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "rabbitmq_producer_buffered_messages",
+			Help: "Messages buffered while RabbitMQ is unreachable",
+		}, func() float64 { return float64(p.Buffered()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "rabbitmq_producer_dropped_messages_total",
+			Help: "Messages dropped because the outage buffer was full",
+		}, func() float64 { return float64(p.Dropped()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "rabbitmq_producer_spool_messages",
+			Help: "Messages waiting in the disk spool",
+		}, func() float64 { return float64(p.Spooled()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "rabbitmq_producer_spool_bytes",
+			Help: "Size of the disk spool segments",
+		}, func() float64 { return float64(p.SpoolSize()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "rabbitmq_producer_spool_oldest_age_seconds",
+			Help: "How long the oldest spooled message has been waiting",
+		}, func() float64 { return p.SpoolAge().Seconds() }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "rabbitmq_producer_spool_dropped_messages_total",
+			Help: "Spooled messages dropped by the spool size and age caps",
+		}, func() float64 { return float64(p.SpoolDropped()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "rabbitmq_producer_spool_corrupt_messages_total",
+			Help: "Spooled messages lost to corrupt spool records",
+		}, func() float64 { return float64(p.SpoolCorrupt()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "rabbitmq_topology_drifted_queues",
+			Help: "Queues that exist on the broker with other settings than configured",
+		}, func() float64 { return float64(len(p.Drifted())) }),
+	)
+}
+
+// ObserveReconnect returns a retry hook that exports reconnect attempts and delays.
+func ObserveReconnect(component, target string) func(attempt int, delay time.Duration) {
+	return func(attempt int, delay time.Duration) {
+		reconnectAttempts.WithLabelValues(component, target).Inc()
+		reconnectDelay.WithLabelValues(component, target).Observe(delay.Seconds())
+	}
 }
 
 func UpdateResourceUsageMetrics(sec int) {
@@ -0,0 +1,90 @@
+package orderbook
+
+import "sync"
+
+type Level struct {
+	Price float64 `json:"price"`
+	Size  float64 `json:"size"`
+}
+
+// Snapshot is a full order book for one market, best levels first.
+type Snapshot struct {
+	Market    string  `json:"market"`
+	Timestamp int64   `json:"timestamp"`
+	Bids      []Level `json:"bids"`
+	Asks      []Level `json:"asks"`
+}
+
+type TopOfBook struct {
+	Market    string  `json:"market"`
+	Timestamp int64   `json:"timestamp"`
+	BidPrice  float64 `json:"bidPrice"`
+	BidSize   float64 `json:"bidSize"`
+	AskPrice  float64 `json:"askPrice"`
+	AskSize   float64 `json:"askSize"`
+}
+
+func (t TopOfBook) sameAs(o TopOfBook) bool {
+	return t.BidPrice == o.BidPrice && t.BidSize == o.BidSize &&
+		t.AskPrice == o.AskPrice && t.AskSize == o.AskSize
+}
+
+// Books keeps the latest order book of every market of a stream.
+type Books struct {
+	mu    sync.RWMutex
+	books map[string]Snapshot
+	tops  map[string]TopOfBook
+}
+
+func NewBooks() *Books {
+	return &Books{
+		books: make(map[string]Snapshot),
+		tops:  make(map[string]TopOfBook),
+	}
+}
+
+// Apply replaces the book of the snapshot's market and reports whether the
+// top of book changed.
+func (b *Books) Apply(s Snapshot) (TopOfBook, bool) {
+	s.Bids = append([]Level(nil), s.Bids...)
+	s.Asks = append([]Level(nil), s.Asks...)
+
+	top := TopOfBook{Market: s.Market, Timestamp: s.Timestamp}
+	if len(s.Bids) > 0 {
+		top.BidPrice, top.BidSize = s.Bids[0].Price, s.Bids[0].Size
+	}
+	if len(s.Asks) > 0 {
+		top.AskPrice, top.AskSize = s.Asks[0].Price, s.Asks[0].Size
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.books[s.Market] = s
+	prev, ok := b.tops[s.Market]
+	b.tops[s.Market] = top
+	return top, !ok || !prev.sameAs(top)
+}
+
+// Get returns a copy of the current book of a market.
+func (b *Books) Get(market string) (Snapshot, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	s, ok := b.books[market]
+	if !ok {
+		return Snapshot{}, false
+	}
+	s.Bids = append([]Level(nil), s.Bids...)
+	s.Asks = append([]Level(nil), s.Asks...)
+	return s, true
+}
+
+// Top returns the current top of book of a market.
+func (b *Books) Top(market string) (TopOfBook, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	top, ok := b.tops[market]
+	return top, ok
+}
@@ -0,0 +1,550 @@
+package registry
+
+import (
+	"common/config"
+	"common/pkg/log"
+	"common/pkg/rabbitmq"
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"upbit/internal/exchange"
+	"upbit/internal/store"
+	"upbit/internal/supervisor"
+	"upbit/internal/ws"
+)
+
+const (
+	// storeTimeout bounds a single store operation.
+	storeTimeout = 5 * time.Second
+	// stopTimeout bounds stopping a stream outside of shutdown.
+	stopTimeout = 10 * time.Second
+)
+
+var (
+	// ErrUnsupported is returned for a data type the platform does not stream.
+	ErrUnsupported = errors.New("unsupported data type")
+	// ErrInvalid is returned for data types that cannot be streamed together.
+	ErrInvalid = errors.New("invalid stream")
+	// ErrConflict is returned when a data type is already streamed by another stream of the platform.
+	ErrConflict = errors.New("data type already streamed")
+	// ErrClosed is returned once the registry is shutting down.
+	ErrClosed = errors.New("registry is shutting down")
+)
+
+// Options tune a stream being started.
+type Options struct {
+	// ShardSize caps the markets per connection, zero keeps the stream on one connection.
+	ShardSize int
+	// IdleTimeout overrides the configured idle timeout when set.
+	IdleTimeout time.Duration
+	// Markets pins the stream to these markets, empty streams every listed market.
+	Markets []string
+	// Sinks are queues published to instead of the market data exchange.
+	Sinks []string
+	// Extra and Excluded are markets added to and removed from the exchange
+	// market list, as by AddMarkets and RemoveMarkets.
+	Extra    []string
+	Excluded []string
+	// StartedBy names who asked for the stream, StartedAt defaults to now.
+	StartedBy string
+	StartedAt time.Time
+}
+
+type entry struct {
+	stream *ws.Stream
+	cancel context.CancelFunc
+}
+
+// Registry owns the running streams. Streams are keyed by platform and their
+// data types joined by commas in sorted order, see DataType.
+//
+// Streams declared in the config are kept running by Reconcile, the control API
+// overrides them: a declared stream stopped through the API stays stopped until
+// it is started again or its declaration changes.
+type Registry struct {
+	cfg   *config.Config
+	rp    *rabbitmq.Producer
+	sup   *supervisor.Supervisor
+	store store.Store
+
+	// storeMu serializes writes to the store, which read the registry again so
+	// that a late write never undoes a later start or stop.
+	storeMu sync.Mutex
+
+	mu         sync.Mutex
+	streams    map[string]map[string]*entry
+	declared   map[string]config.Stream
+	overridden map[string]bool
+	manual     map[string]bool
+	closed     bool
+}
+
+// New returns an empty registry. Streams started through Start are saved to st
+// and brought back by Restore, st may be nil.
+func New(cfg *config.Config, rp *rabbitmq.Producer, sup *supervisor.Supervisor, st store.Store) *Registry {
+	return &Registry{
+		cfg:        cfg,
+		rp:         rp,
+		sup:        sup,
+		store:      st,
+		streams:    make(map[string]map[string]*entry),
+		declared:   make(map[string]config.Stream),
+		overridden: make(map[string]bool),
+		manual:     make(map[string]bool),
+	}
+}
+
+func key(platform, dataType string) string {
+	return platform + "/" + dataType
+}
+
+// DefaultOptions returns the options configured for every stream.
+func (r *Registry) DefaultOptions() Options {
+	return Options{ShardSize: r.cfg.WebSocket.ShardSize}
+}
+
+// DataTypes normalises a list of data types: blanks and duplicates are dropped
+// and the rest sorted, so "trade,ticker" and "ticker,trade" name the same stream.
+func DataTypes(dataTypes []string) []string {
+	seen := make(map[string]bool)
+	var types []string
+	for _, dataType := range dataTypes {
+		dataType = strings.TrimSpace(dataType)
+		if dataType == "" || seen[dataType] {
+			continue
+		}
+		seen[dataType] = true
+		types = append(types, dataType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// DataType returns the key of a stream of the given data types.
+func DataType(dataTypes []string) string {
+	return strings.Join(DataTypes(dataTypes), ",")
+}
+
+// Start starts a stream unless it already runs. It returns the stream and
+// whether this call started it. Started streams are saved to the store.
+func (r *Registry) Start(platform string, dataTypes []string, opts Options) (*ws.Stream, bool, error) {
+	stream, started, err := r.launch(platform, dataTypes, opts, nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	r.mu.Lock()
+	k := key(platform, stream.DataType())
+	// A running config stream becomes a control API one, saved like a started
+	// one. A stream stopped meanwhile is left to the Stop.
+	save := false
+	if r.running(stream) {
+		save = started || !r.manual[k]
+		delete(r.overridden, k)
+		r.manual[k] = true
+	}
+	r.mu.Unlock()
+
+	if save {
+		r.persist(platform, stream.DataType())
+	}
+	return stream, started, nil
+}
+
+// AddMarkets adds markets to a running stream once ws.Stream.CheckMarkets
+// accepts them. The change is saved with the streams started through the
+// control API and reapplied by Restore.
+func (r *Registry) AddMarkets(ctx context.Context, stream *ws.Stream, markets []string) error {
+	if err := stream.CheckMarkets(ctx, markets); err != nil {
+		return err
+	}
+	stream.AddMarkets(markets)
+	r.persistManual(stream)
+	return nil
+}
+
+// RemoveMarkets removes markets from a running stream that takes markets, saved
+// like AddMarkets. Markets the platform no longer lists may be removed.
+func (r *Registry) RemoveMarkets(ctx context.Context, stream *ws.Stream, markets []string) error {
+	if err := stream.CheckMarkets(ctx, nil); err != nil {
+		return err
+	}
+	stream.RemoveMarkets(markets)
+	r.persistManual(stream)
+	return nil
+}
+
+func (r *Registry) persistManual(stream *ws.Stream) {
+	r.mu.Lock()
+	manual := r.manual[key(stream.Platform, stream.DataType())]
+	r.mu.Unlock()
+
+	if manual {
+		r.persist(stream.Platform, stream.DataType())
+	}
+}
+
+// Restore starts the streams saved in the store, as left by the previous run.
+func (r *Registry) Restore(ctx context.Context) {
+	if r.store == nil {
+		return
+	}
+	records, err := r.store.Load(ctx)
+	if err != nil {
+		log.Logger.Error("Failed to load saved streams", zap.Error(err))
+		return
+	}
+
+	for _, record := range records {
+		opts := Options{
+			ShardSize:   record.ShardSize,
+			IdleTimeout: record.IdleTimeout,
+			Markets:     record.Markets,
+			Sinks:       record.Sinks,
+			Extra:       record.Extra,
+			Excluded:    record.Excluded,
+			StartedBy:   record.StartedBy,
+			StartedAt:   record.StartedAt,
+		}
+		stream, _, err := r.launch(record.Platform, strings.Split(record.DataType, ","), opts, nil)
+		if err != nil {
+			log.Logger.Error(fmt.Sprintf("Failed to restore stream %s", key(record.Platform, record.DataType)), zap.Error(err))
+			continue
+		}
+		r.mu.Lock()
+		if r.running(stream) {
+			r.manual[key(record.Platform, stream.DataType())] = true
+		}
+		r.mu.Unlock()
+		log.Logger.Info(fmt.Sprintf("Restored stream %s started by %s at %s", key(record.Platform, record.DataType), record.StartedBy, record.StartedAt.Format(time.RFC3339)))
+	}
+}
+
+// persist keeps the store in line with a stream started through the control
+// API: it is saved while it runs and deleted once stopped, as the registry
+// holds it by the time the store is written to. r.mu must not be held, store
+// calls may take seconds. Failures are logged, the stream keeps running.
+func (r *Registry) persist(platform, dataType string) {
+	if r.store == nil {
+		return
+	}
+	r.storeMu.Lock()
+	defer r.storeMu.Unlock()
+
+	r.mu.Lock()
+	e, running := r.streams[platform][dataType]
+	running = running && r.manual[key(platform, dataType)]
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if !running {
+		if err := r.store.Delete(ctx, platform, dataType); err != nil {
+			log.Logger.Error("Failed to delete saved stream", zap.Error(err))
+		}
+		return
+	}
+	if err := r.store.Save(ctx, record(e.stream)); err != nil {
+		log.Logger.Error("Failed to save stream", zap.Error(err))
+	}
+}
+
+// record describes a running stream for the store.
+func record(stream *ws.Stream) store.Record {
+	extra, excluded := stream.Overrides()
+	return store.Record{
+		Platform:    stream.Platform,
+		DataType:    stream.DataType(),
+		ShardSize:   stream.ShardSize,
+		IdleTimeout: stream.IdleTimeout,
+		Markets:     stream.Pinned,
+		Sinks:       stream.Sinks,
+		Extra:       extra,
+		Excluded:    excluded,
+		StartedBy:   stream.StartedBy,
+		StartedAt:   stream.StartedAt,
+	}
+}
+
+// launch starts a stream unless it already runs, like start, but takes r.mu
+// itself so that the sinks of a new stream are declared without it: a declare
+// is a broker round-trip. wanted, when set, is checked under r.mu before the
+// declare and before the start, which is dropped once it returns false.
+func (r *Registry) launch(platform string, dataTypes []string, opts Options, wanted func() bool) (*ws.Stream, bool, error) {
+	types := DataTypes(dataTypes)
+
+	r.mu.Lock()
+	if wanted != nil && !wanted() {
+		r.mu.Unlock()
+		return nil, false, nil
+	}
+	running, _, err := r.check(platform, types)
+	r.mu.Unlock()
+	if err != nil || running != nil {
+		return running, false, err
+	}
+
+	if r.rp != nil {
+		for _, sink := range opts.Sinks {
+			if err := r.rp.DeclareQueue(sink); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if wanted != nil && !wanted() {
+		return nil, false, nil
+	}
+	return r.start(platform, types, opts)
+}
+
+// check validates a stream about to be started and returns it when it already
+// runs, r.mu must be held.
+func (r *Registry) check(platform string, types []string) (*ws.Stream, exchange.Exchange, error) {
+	dataType := strings.Join(types, ",")
+	if r.closed {
+		return nil, nil, ErrClosed
+	}
+	if len(types) == 0 {
+		return nil, nil, fmt.Errorf("%w: dataType is required", ErrInvalid)
+	}
+
+	if e, ok := r.streams[platform][dataType]; ok {
+		return e.stream, nil, nil
+	}
+	for running, e := range r.streams[platform] {
+		for _, t := range e.stream.DataTypes {
+			if slices.Contains(types, t) {
+				return nil, nil, fmt.Errorf("%w: %s is already streamed by %s/%s", ErrConflict, t, platform, running)
+			}
+		}
+	}
+
+	ex, err := exchange.New(platform, r.cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, t := range types {
+		if !ex.Supports(t) {
+			return nil, nil, fmt.Errorf("%w: %s does not support %s", ErrUnsupported, platform, t)
+		}
+	}
+	if m, ok := ex.(exchange.Multiplexer); ok && len(types) > 1 {
+		if err := m.Multiplex(types); err != nil {
+			return nil, nil, fmt.Errorf("%w: %s cannot share a connection: %v", ErrInvalid, dataType, err)
+		}
+	}
+	return nil, ex, nil
+}
+
+// start starts a stream unless it already runs, r.mu must be held. Its sinks
+// are declared by launch beforehand.
+func (r *Registry) start(platform string, dataTypes []string, opts Options) (*ws.Stream, bool, error) {
+	types := DataTypes(dataTypes)
+	running, ex, err := r.check(platform, types)
+	if err != nil || running != nil {
+		return running, false, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := ws.NewStream(ex, types, opts.ShardSize, r.cfg, r.rp, r.sup)
+	stream.IdleTimeout = opts.IdleTimeout
+	stream.Pinned = opts.Markets
+	stream.Sinks = opts.Sinks
+	stream.AddMarkets(opts.Extra)
+	stream.RemoveMarkets(opts.Excluded)
+	stream.StartedBy = opts.StartedBy
+	stream.StartedAt = opts.StartedAt
+	if stream.StartedAt.IsZero() {
+		stream.StartedAt = time.Now()
+	}
+	stream.Start(ctx)
+
+	dataType := stream.DataType()
+	if r.streams[platform] == nil {
+		r.streams[platform] = make(map[string]*entry)
+	}
+	r.streams[platform][dataType] = &entry{stream: stream, cancel: cancel}
+	log.Logger.Info(fmt.Sprintf("Started %s %s", platform, dataType))
+	return stream, true, nil
+}
+
+// running reports whether stream is still registered, r.mu must be held.
+func (r *Registry) running(stream *ws.Stream) bool {
+	e, ok := r.streams[stream.Platform][stream.DataType()]
+	return ok && e.stream == stream
+}
+
+// Stop stops a stream, waiting for its queued messages until ctx is done. It
+// returns false when the stream was not running.
+func (r *Registry) Stop(ctx context.Context, platform, dataType string) bool {
+	dataType = DataType(strings.Split(dataType, ","))
+
+	r.mu.Lock()
+	e := r.remove(platform, dataType)
+	manual := r.manual[key(platform, dataType)]
+	delete(r.manual, key(platform, dataType))
+	if _, ok := r.declared[key(platform, dataType)]; ok && e != nil {
+		r.overridden[key(platform, dataType)] = true
+	}
+	r.mu.Unlock()
+
+	if manual {
+		r.persist(platform, dataType)
+	}
+	if e == nil {
+		return false
+	}
+	e.cancel()
+	e.stop(ctx)
+	return true
+}
+
+// remove takes a stream out of the registry, r.mu must be held.
+func (r *Registry) remove(platform, dataType string) *entry {
+	e, ok := r.streams[platform][dataType]
+	if !ok {
+		return nil
+	}
+	delete(r.streams[platform], dataType)
+	if len(r.streams[platform]) == 0 {
+		delete(r.streams, platform)
+	}
+	return e
+}
+
+// stop waits for a cancelled stream to wind down.
+func (e *entry) stop(ctx context.Context) {
+	if err := e.stream.Stop(ctx); err != nil {
+		log.Logger.Error(fmt.Sprintf("Failed to stop %s %s cleanly", e.stream.Platform, e.stream.DataType()), zap.Error(err))
+		return
+	}
+	log.Logger.Info(fmt.Sprintf("Stopped %s %s", e.stream.Platform, e.stream.DataType()))
+}
+
+// Reconcile makes the running streams match the declared ones. Streams that are
+// no longer declared are stopped, changed declarations are restarted and
+// streams started through the control API, declared or not, are left alone.
+func (r *Registry) Reconcile(declared []config.Stream) {
+	desired := make(map[string]config.Stream, len(declared))
+	for _, d := range declared {
+		d.DataType = DataType(strings.Split(d.DataType, ","))
+		if d.Platform == "" || d.DataType == "" {
+			log.Logger.Error(fmt.Sprintf("Ignoring stream declaration without platform or dataType: %+v", d))
+			continue
+		}
+		desired[key(d.Platform, d.DataType)] = d
+	}
+
+	// Only the diff is made under r.mu, stopping and starting streams takes
+	// seconds the control API would otherwise wait for.
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	var stale []*entry
+	for k, previous := range r.declared {
+		d, ok := desired[k]
+		if ok && reflect.DeepEqual(d, previous) || r.manual[k] {
+			continue
+		}
+		delete(r.overridden, k)
+		if e := r.remove(previous.Platform, previous.DataType); e != nil {
+			stale = append(stale, e)
+		}
+	}
+	r.declared = desired
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	for _, e := range stale {
+		e.cancel()
+	}
+	for _, e := range stale {
+		e.stop(ctx)
+	}
+	cancel()
+
+	for k, d := range desired {
+		opts := r.DefaultOptions()
+		opts.Markets = d.Markets
+		opts.Sinks = d.Sinks
+		opts.StartedBy = "config"
+		// A Stop through the control API or a newer Reconcile wins over this one.
+		wanted := func() bool {
+			return !r.closed && !r.overridden[k] && reflect.DeepEqual(r.declared[k], d)
+		}
+		if _, started, err := r.launch(d.Platform, strings.Split(d.DataType, ","), opts, wanted); err != nil {
+			log.Logger.Error(fmt.Sprintf("Failed to start declared stream %s", k), zap.Error(err))
+		} else if started {
+			log.Logger.Info(fmt.Sprintf("Started declared stream %s", k))
+		}
+	}
+}
+
+// Close stops every stream, waiting for them until ctx is done, and refuses to
+// start new ones. Unlike Stop it keeps the saved streams, they are restored by
+// the next run.
+func (r *Registry) Close(ctx context.Context) {
+	r.mu.Lock()
+	r.closed = true
+	var entries []*entry
+	for platform, dataTypeMap := range r.streams {
+		for dataType := range dataTypeMap {
+			entries = append(entries, r.remove(platform, dataType))
+		}
+	}
+	r.mu.Unlock()
+
+	// Cancel them all first so that they wind down together.
+	for _, e := range entries {
+		e.cancel()
+	}
+	for _, e := range entries {
+		e.stop(ctx)
+	}
+}
+
+// Get returns a running stream.
+func (r *Registry) Get(platform, dataType string) (*ws.Stream, bool) {
+	dataType = DataType(strings.Split(dataType, ","))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.streams[platform][dataType]
+	if !ok {
+		return nil, false
+	}
+	return e.stream, true
+}
+
+// List returns the running streams sorted by platform and data type.
+func (r *Registry) List() []*ws.Stream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var streams []*ws.Stream
+	for _, dataTypeMap := range r.streams {
+		for _, e := range dataTypeMap {
+			streams = append(streams, e.stream)
+		}
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		if streams[i].Platform != streams[j].Platform {
+			return streams[i].Platform < streams[j].Platform
+		}
+		return streams[i].DataType() < streams[j].DataType()
+	})
+	return streams
+}
@@ -0,0 +1,326 @@
+package registry
+
+import (
+	"common/config"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+	"upbit/internal/exchange"
+	"upbit/internal/store"
+	"upbit/internal/supervisor"
+	"upbit/internal/ws"
+)
+
+const offline = "offline"
+
+// offlineExchange supports trades, tickers and myAsset, which takes no markets,
+// but never connects, so its streams keep backing off until they are stopped.
+type offlineExchange struct{}
+
+func (offlineExchange) Name() string { return offline }
+func (offlineExchange) Supports(dataType string) bool {
+	return dataType == "trade" || dataType == "ticker" || dataType == "myAsset"
+}
+func (offlineExchange) Dial([]string) (string, http.Header, error) {
+	return "", nil, errors.New("offline")
+}
+func (offlineExchange) Markets(_ context.Context, dataType string) ([]string, error) {
+	if dataType == "myAsset" {
+		return nil, nil
+	}
+	return []string{"KRW-BTC"}, nil
+}
+func (offlineExchange) Unlisted(_ context.Context, markets []string) ([]string, error) {
+	var unlisted []string
+	for _, market := range markets {
+		if market != "KRW-BTC" && market != "KRW-ETH" && market != "KRW-XRP" {
+			unlisted = append(unlisted, market)
+		}
+	}
+	return unlisted, nil
+}
+func (offlineExchange) Subscribe([]exchange.Subscription) ([][]byte, error) { return nil, nil }
+func (offlineExchange) Decode([]byte) ([]exchange.Message, error)           { return nil, nil }
+func (offlineExchange) Keepalive() (time.Duration, []byte)                  { return 0, nil }
+
+func init() {
+	exchange.Register(offline, func(*config.Config) (exchange.Exchange, error) {
+		return offlineExchange{}, nil
+	})
+}
+
+func newRegistry(t *testing.T) (*Registry, *supervisor.Supervisor) {
+	t.Helper()
+	return newRegistryWithStore(t, nil)
+}
+
+func newRegistryWithStore(t *testing.T, st store.Store) (*Registry, *supervisor.Supervisor) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	sup := supervisor.New(supervisor.Options{})
+	go sup.Run(ctx)
+
+	r := New(&config.Config{}, nil, sup, st)
+	t.Cleanup(func() {
+		stopCtx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+		defer stop()
+		r.Close(stopCtx)
+		if err := sup.Wait(stopCtx); err != nil {
+			t.Errorf("connection managers did not stop: %v", err)
+		}
+		cancel()
+	})
+	return r, sup
+}
+
+func TestStartIsIdempotent(t *testing.T) {
+	r, _ := newRegistry(t)
+
+	first, started, err := r.Start(offline, []string{"trade", "ticker"}, Options{})
+	if err != nil || !started {
+		t.Fatalf("Start = %v, %v, want started", started, err)
+	}
+	again, started, err := r.Start(offline, []string{"ticker", "trade"}, Options{})
+	if err != nil || started {
+		t.Fatalf("second Start = %v, %v, want running stream", started, err)
+	}
+	if again != first {
+		t.Fatal("second Start returned another stream")
+	}
+	if streams := r.List(); len(streams) != 1 {
+		t.Fatalf("List returned %d streams, want 1", len(streams))
+	}
+}
+
+func TestStopIsIdempotent(t *testing.T) {
+	r, _ := newRegistry(t)
+	ctx := context.Background()
+
+	if _, _, err := r.Start(offline, []string{"trade"}, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if !r.Stop(ctx, offline, "trade") {
+		t.Fatal("Stop of a running stream returned false")
+	}
+	if r.Stop(ctx, offline, "trade") {
+		t.Fatal("Stop of a stopped stream returned true")
+	}
+	if _, ok := r.Get(offline, "trade"); ok {
+		t.Fatal("stopped stream is still registered")
+	}
+	if _, started, err := r.Start(offline, []string{"trade"}, Options{}); err != nil || !started {
+		t.Fatalf("Start after Stop = %v, %v, want started", started, err)
+	}
+}
+
+func TestStartConflicts(t *testing.T) {
+	r, _ := newRegistry(t)
+
+	if _, _, err := r.Start(offline, []string{"trade"}, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.Start(offline, []string{"trade", "ticker"}, Options{}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Start of an overlapping stream = %v, want ErrConflict", err)
+	}
+	if _, _, err := r.Start(offline, []string{"orderbook"}, Options{}); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("Start of an unsupported data type = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestConcurrentStartStop(t *testing.T) {
+	r, sup := newRegistry(t)
+	ctx := context.Background()
+	dataTypes := []string{"trade", "ticker"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				dataType := dataTypes[(i+j)%len(dataTypes)]
+				switch (i + j) % 4 {
+				case 0, 1:
+					if _, _, err := r.Start(offline, []string{dataType}, Options{StartedBy: fmt.Sprint(i)}); err != nil {
+						t.Errorf("Start %s: %v", dataType, err)
+					}
+				case 2:
+					r.Stop(ctx, offline, dataType)
+				case 3:
+					if s, ok := r.Get(offline, dataType); ok {
+						s.Status()
+					}
+					for _, s := range r.List() {
+						s.Status()
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, dataType := range dataTypes {
+		r.Stop(ctx, offline, dataType)
+	}
+	if streams := r.List(); len(streams) != 0 {
+		t.Fatalf("List returned %d streams after stopping all, want 0", len(streams))
+	}
+	stopCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := sup.Wait(stopCtx); err != nil {
+		t.Fatalf("connection managers did not stop: %v", err)
+	}
+}
+
+func TestCloseRefusesStart(t *testing.T) {
+	r, _ := newRegistry(t)
+
+	if _, _, err := r.Start(offline, []string{"trade"}, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r.Close(ctx)
+
+	if streams := r.List(); len(streams) != 0 {
+		t.Fatalf("List returned %d streams after Close, want 0", len(streams))
+	}
+	if _, _, err := r.Start(offline, []string{"trade"}, Options{}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Start after Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestRestoreReappliesOptionsAndOverrides(t *testing.T) {
+	st := store.NewFileStore(filepath.Join(t.TempDir(), "streams.json"))
+	r, _ := newRegistryWithStore(t, st)
+
+	opts := Options{
+		ShardSize:   2,
+		IdleTimeout: time.Minute,
+		Markets:     []string{"KRW-BTC", "KRW-ETH"},
+		Sinks:       []string{"sink_queue"},
+		StartedBy:   "test",
+	}
+	stream, _, err := r.Start(offline, []string{"trade"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddMarkets(context.Background(), stream, []string{"KRW-XRP"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RemoveMarkets(context.Background(), stream, []string{"KRW-ETH"}); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, _ := newRegistryWithStore(t, st)
+	restored.Restore(context.Background())
+	got, ok := restored.Get(offline, "trade")
+	if !ok {
+		t.Fatal("stream was not restored")
+	}
+	if got.ShardSize != 2 || got.IdleTimeout != time.Minute || got.StartedBy != "test" {
+		t.Fatalf("restored %d, %s, %s, want the options it was started with", got.ShardSize, got.IdleTimeout, got.StartedBy)
+	}
+	if !reflect.DeepEqual(got.Pinned, opts.Markets) || !reflect.DeepEqual(got.Sinks, opts.Sinks) {
+		t.Fatalf("restored markets %v and sinks %v, want %v and %v", got.Pinned, got.Sinks, opts.Markets, opts.Sinks)
+	}
+	extra, excluded := got.Overrides()
+	if !reflect.DeepEqual(extra, []string{"KRW-XRP"}) || !reflect.DeepEqual(excluded, []string{"KRW-ETH"}) {
+		t.Fatalf("restored overrides %v and %v, want [KRW-XRP] and [KRW-ETH]", extra, excluded)
+	}
+
+	// Stopping forgets the stream.
+	restored.Stop(context.Background(), offline, "trade")
+	if records, err := st.Load(context.Background()); err != nil || len(records) != 0 {
+		t.Fatalf("store holds %v, %v after Stop, want nothing", records, err)
+	}
+}
+
+func TestStartSavesRunningConfigStream(t *testing.T) {
+	st := store.NewFileStore(filepath.Join(t.TempDir(), "streams.json"))
+	r, _ := newRegistryWithStore(t, st)
+
+	r.Reconcile([]config.Stream{{Platform: offline, DataType: "trade"}})
+	if records, err := st.Load(context.Background()); err != nil || len(records) != 0 {
+		t.Fatalf("store holds %v, %v for a config stream, want nothing", records, err)
+	}
+
+	// Starting it through the control API keeps it across restarts.
+	if _, started, err := r.Start(offline, []string{"trade"}, Options{}); err != nil || started {
+		t.Fatalf("Start = %v, %v, want the running stream", started, err)
+	}
+	records, err := st.Load(context.Background())
+	if err != nil || len(records) != 1 || records[0].DataType != "trade" {
+		t.Fatalf("store holds %v, %v, want the trade stream", records, err)
+	}
+}
+
+func TestChangeMarketsChecksStream(t *testing.T) {
+	r, _ := newRegistry(t)
+	ctx := context.Background()
+
+	assets, _, err := r.Start(offline, []string{"myAsset"}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddMarkets(ctx, assets, []string{"KRW-BTC"}); !errors.Is(err, ws.ErrNoMarkets) {
+		t.Fatalf("AddMarkets to myAsset = %v, want ErrNoMarkets", err)
+	}
+	if err := r.RemoveMarkets(ctx, assets, []string{"KRW-BTC"}); !errors.Is(err, ws.ErrNoMarkets) {
+		t.Fatalf("RemoveMarkets from myAsset = %v, want ErrNoMarkets", err)
+	}
+
+	trades, _, err := r.Start(offline, []string{"trade"}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddMarkets(ctx, trades, []string{"KRW-ETH", "KRW-NOPE"}); !errors.Is(err, ws.ErrUnlisted) {
+		t.Fatalf("AddMarkets of an unlisted market = %v, want ErrUnlisted", err)
+	}
+	if extra, _ := trades.Overrides(); len(extra) != 0 {
+		t.Fatalf("rejected markets %v were added", extra)
+	}
+	// A market no longer listed can still be removed.
+	if err := r.RemoveMarkets(ctx, trades, []string{"KRW-NOPE"}); err != nil {
+		t.Fatalf("RemoveMarkets = %v, want nil", err)
+	}
+}
+
+func TestReconcileFollowsDeclarations(t *testing.T) {
+	r, _ := newRegistry(t)
+
+	r.Reconcile([]config.Stream{{Platform: offline, DataType: "trade", Markets: []string{"KRW-BTC"}}})
+	first, ok := r.Get(offline, "trade")
+	if !ok {
+		t.Fatal("declared stream was not started")
+	}
+
+	// A changed declaration restarts the stream with it.
+	r.Reconcile([]config.Stream{{Platform: offline, DataType: "trade", Markets: []string{"KRW-ETH"}}})
+	second, ok := r.Get(offline, "trade")
+	if !ok || second == first || !reflect.DeepEqual(second.Pinned, []string{"KRW-ETH"}) {
+		t.Fatalf("changed declaration was not restarted")
+	}
+
+	// A stream stopped through the control API stays stopped.
+	r.Stop(context.Background(), offline, "trade")
+	r.Reconcile([]config.Stream{{Platform: offline, DataType: "trade", Markets: []string{"KRW-ETH"}}})
+	if _, ok := r.Get(offline, "trade"); ok {
+		t.Fatal("stopped declared stream was started again")
+	}
+
+	r.Reconcile([]config.Stream{{Platform: offline, DataType: "ticker"}})
+	if _, ok := r.Get(offline, "ticker"); !ok {
+		t.Fatal("new declaration was not started")
+	}
+	r.Reconcile(nil)
+	if streams := r.List(); len(streams) != 0 {
+		t.Fatalf("List returned %d streams once nothing is declared, want 0", len(streams))
+	}
+}
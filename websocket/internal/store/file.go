@@ -0,0 +1,128 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// FileStore keeps the records in a JSON file.
+type FileStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+func (f *FileStore) Save(_ context.Context, record Record) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	records, err := f.read()
+	if err != nil {
+		return err
+	}
+	records[key(record.Platform, record.DataType)] = record
+	return f.write(records)
+}
+
+func (f *FileStore) Delete(_ context.Context, platform, dataType string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	records, err := f.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := records[key(platform, dataType)]; !ok {
+		return nil
+	}
+	delete(records, key(platform, dataType))
+	return f.write(records)
+}
+
+func (f *FileStore) Load(_ context.Context) ([]Record, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	records, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Record, 0, len(records))
+	for _, record := range records {
+		list = append(list, record)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return key(list[i].Platform, list[i].DataType) < key(list[j].Platform, list[j].DataType)
+	})
+	return list, nil
+}
+
+// Close does nothing, every write is complete once Save or Delete returns.
+func (f *FileStore) Close(context.Context) error {
+	return nil
+}
+
+func (f *FileStore) read() (map[string]Record, error) {
+	records := make(map[string]Record)
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", f.path, err)
+	}
+
+	var list []Record
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", f.path, err)
+	}
+	for _, record := range list {
+		records[key(record.Platform, record.DataType)] = record
+	}
+	return records, nil
+}
+
+// write replaces the file in one rename so a crash never leaves it half written.
+func (f *FileStore) write(records map[string]Record) error {
+	list := make([]Record, 0, len(records))
+	for _, record := range records {
+		list = append(list, record)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return key(list[i].Platform, list[i].DataType) < key(list[j].Platform, list[j].DataType)
+	})
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", f.path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %v", f.path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", f.path, err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to write %s: %v", f.path, err)
+	}
+	return nil
+}
+
+func key(platform, dataType string) string {
+	return platform + "/" + dataType
+}
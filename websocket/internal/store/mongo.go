@@ -0,0 +1,58 @@
+package store
+
+import (
+	"common/pkg/mongo"
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	driver "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const collection = "streams"
+
+// MongoStore keeps the records in the streams collection, one document per stream.
+type MongoStore struct {
+	client  *mongo.Client
+	streams *driver.Collection
+}
+
+func NewMongoStore(client *mongo.Client) *MongoStore {
+	return &MongoStore{client: client, streams: client.Collection(collection)}
+}
+
+func (m *MongoStore) Save(ctx context.Context, record Record) error {
+	filter := bson.M{"_id": key(record.Platform, record.DataType)}
+	_, err := m.streams.ReplaceOne(ctx, filter, record, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to save stream %s: %v", filter["_id"], err)
+	}
+	return nil
+}
+
+func (m *MongoStore) Delete(ctx context.Context, platform, dataType string) error {
+	if _, err := m.streams.DeleteOne(ctx, bson.M{"_id": key(platform, dataType)}); err != nil {
+		return fmt.Errorf("failed to delete stream %s: %v", key(platform, dataType), err)
+	}
+	return nil
+}
+
+func (m *MongoStore) Load(ctx context.Context) ([]Record, error) {
+	cursor, err := m.streams.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load streams: %v", err)
+	}
+	var records []Record
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, fmt.Errorf("failed to load streams: %v", err)
+	}
+	return records, nil
+}
+
+// Close disconnects the MongoDB client.
+func (m *MongoStore) Close(ctx context.Context) error {
+	if err := m.client.Close(ctx); err != nil {
+		return fmt.Errorf("failed to disconnect from MongoDB: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package store
+
+import (
+	"common/config"
+	"common/pkg/log"
+	"common/pkg/mongo"
+	"context"
+	"fmt"
+	"time"
+)
+
+const defaultStateFile = "streams.json"
+
+// Record is a stream started through the control API, kept so that it is
+// started again after a restart.
+type Record struct {
+	Platform    string        `json:"platform" bson:"platform"`
+	DataType    string        `json:"dataType" bson:"dataType"`
+	ShardSize   int           `json:"shardSize" bson:"shardSize"`
+	IdleTimeout time.Duration `json:"idleTimeout,omitempty" bson:"idleTimeout,omitempty"`
+	StartedBy   string        `json:"startedBy" bson:"startedBy"`
+	StartedAt   time.Time     `json:"startedAt" bson:"startedAt"`
+	// Markets pins the stream to these markets and Sinks are the queues it publishes to.
+	Markets []string `json:"markets,omitempty" bson:"markets,omitempty"`
+	Sinks   []string `json:"sinks,omitempty" bson:"sinks,omitempty"`
+	// Extra and Excluded are the markets added and removed while the stream ran.
+	Extra    []string `json:"extra,omitempty" bson:"extra,omitempty"`
+	Excluded []string `json:"excluded,omitempty" bson:"excluded,omitempty"`
+}
+
+// Store keeps the desired state of the streams started through the control API.
+type Store interface {
+	Save(ctx context.Context, record Record) error
+	Delete(ctx context.Context, platform, dataType string) error
+	Load(ctx context.Context) ([]Record, error)
+	// Close releases the store once the registry no longer writes to it.
+	Close(ctx context.Context) error
+}
+
+// New returns a MongoDB store when MongoDB is configured and reachable and a
+// file store otherwise.
+func New(ctx context.Context, cfg *config.Config) Store {
+	if cfg.Mongo.URI != "" {
+		client, err := mongo.Connect(ctx, cfg)
+		if err == nil {
+			return NewMongoStore(client)
+		}
+		log.Logger.Error(fmt.Sprintf("Falling back to the state file: %v", err))
+	}
+
+	path := cfg.WebSocket.StateFile
+	if path == "" {
+		path = defaultStateFile
+	}
+	log.Logger.Info(fmt.Sprintf("Keeping stream state in %s", path))
+	return NewFileStore(path)
+}
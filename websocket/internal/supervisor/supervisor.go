@@ -0,0 +1,276 @@
+package supervisor
+
+import (
+	"common/pkg/log"
+	"common/pkg/retry"
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+	"upbit/internal/metrics"
+)
+
+const (
+	defaultCrashLoopWindow   = 5 * time.Minute
+	defaultCrashLoopRestarts = 5
+)
+
+type EventKind string
+
+const (
+	// Disconnected is reported by a running child that lost its connection and reconnects on its own.
+	Disconnected EventKind = "disconnected"
+	// Exited is reported when a child returned and gets restarted.
+	Exited EventKind = "exited"
+	// Panicked is reported when a child panicked and gets restarted.
+	Panicked EventKind = "panicked"
+)
+
+type Event struct {
+	Name string
+	Kind EventKind
+	Err  error
+	Time time.Time
+}
+
+// Status is what the supervisor knows about one child.
+type Status struct {
+	Name         string    `json:"name"`
+	Running      bool      `json:"running"`
+	StartedAt    time.Time `json:"startedAt"`
+	Reconnects   int       `json:"reconnects"`
+	Restarts     int       `json:"restarts"`
+	LastError    string    `json:"lastError,omitempty"`
+	LastErrorAt  time.Time `json:"lastErrorAt,omitempty"`
+	CrashLooping bool      `json:"crashLooping"`
+}
+
+type child struct {
+	status   Status
+	restarts []time.Time
+}
+
+// Options tune crash loop detection and the delay between restarts.
+type Options struct {
+	// CrashLoopWindow and CrashLoopRestarts flag a child restarted that many times within the window.
+	CrashLoopWindow   time.Duration
+	CrashLoopRestarts int
+	// Restart spaces out restarts of the same child.
+	Restart retry.Policy
+}
+
+// Supervisor runs the connection managers, restarts them when they return or
+// panic and keeps track of their reconnects and errors.
+type Supervisor struct {
+	opts    Options
+	events  chan Event
+	done    chan struct{}
+	running sync.WaitGroup
+
+	mu       sync.Mutex
+	children map[string]*child
+}
+
+func New(opts Options) *Supervisor {
+	if opts.CrashLoopWindow <= 0 {
+		opts.CrashLoopWindow = defaultCrashLoopWindow
+	}
+	if opts.CrashLoopRestarts <= 0 {
+		opts.CrashLoopRestarts = defaultCrashLoopRestarts
+	}
+	return &Supervisor{
+		opts:     opts,
+		events:   make(chan Event, 64),
+		done:     make(chan struct{}),
+		children: make(map[string]*child),
+	}
+}
+
+// Run consumes the events reported by the children until ctx is done.
+func (s *Supervisor) Run(ctx context.Context) {
+	defer close(s.done)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-s.events:
+			s.record(ev)
+		}
+	}
+}
+
+// Report hands an event to the supervisor. It never blocks once the supervisor stopped.
+func (s *Supervisor) Report(name string, kind EventKind, err error) {
+	ev := Event{Name: name, Kind: kind, Err: err, Time: time.Now()}
+	select {
+	case s.events <- ev:
+	case <-s.done:
+	}
+}
+
+func (s *Supervisor) record(ev Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.children[ev.Name]
+	if !ok {
+		return
+	}
+	if ev.Err != nil {
+		c.status.LastError = ev.Err.Error()
+		c.status.LastErrorAt = ev.Time
+	}
+
+	switch ev.Kind {
+	case Disconnected:
+		c.status.Reconnects++
+		return
+	case Exited, Panicked:
+		c.status.Restarts++
+		metrics.SupervisorRestarts.WithLabelValues(ev.Name, string(ev.Kind)).Inc()
+	}
+
+	// Only restarts within the window count towards a crash loop.
+	cutoff := ev.Time.Add(-s.opts.CrashLoopWindow)
+	recent := c.restarts[:0]
+	for _, t := range c.restarts {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	c.restarts = append(recent, ev.Time)
+
+	looping := len(c.restarts) >= s.opts.CrashLoopRestarts
+	if looping && !c.status.CrashLooping {
+		log.Logger.Error(fmt.Sprintf("%s is crash looping: %d restarts within %s", ev.Name, len(c.restarts), s.opts.CrashLoopWindow))
+	}
+	c.status.CrashLooping = looping
+	s.setCrashLoopMetric(ev.Name, looping)
+}
+
+func (s *Supervisor) setCrashLoopMetric(name string, looping bool) {
+	value := 0.0
+	if looping {
+		value = 1
+	}
+	metrics.SupervisorCrashLooping.WithLabelValues(name).Set(value)
+}
+
+// Go runs fn under supervision until ctx is done. fn is restarted with backoff
+// whenever it returns or panics. The returned channel is closed once fn
+// returned for good.
+func (s *Supervisor) Go(ctx context.Context, name string, fn func(ctx context.Context) error) <-chan struct{} {
+	c := &child{status: Status{Name: name, Running: true, StartedAt: time.Now()}}
+	s.mu.Lock()
+	s.children[name] = c
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		defer close(done)
+		defer s.forget(name, c)
+
+		backoff := retry.NewBackoff(s.opts.Restart)
+		backoff.OnRetry = metrics.ObserveReconnect("supervisor", name)
+		for {
+			backoff.Connected()
+			kind, err := s.runSafely(ctx, name, fn)
+			backoff.Disconnected()
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Logger.Error(fmt.Sprintf("%s %s, restarting", name, kind), zap.Error(err))
+			s.Report(name, kind, err)
+			s.setRunning(name, false)
+			if err := backoff.Wait(ctx); err != nil {
+				if ctx.Err() == nil {
+					log.Logger.Error(fmt.Sprintf("Giving up on %s", name), zap.Error(err))
+				}
+				return
+			}
+			s.setRunning(name, true)
+		}
+	}()
+	return done
+}
+
+// Wait blocks until every child returned for good, which happens once their
+// contexts are cancelled, or until ctx is done.
+func (s *Supervisor) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Supervisor) runSafely(ctx context.Context, name string, fn func(ctx context.Context) error) (kind EventKind, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Logger.Error(fmt.Sprintf("Recovered in %s: %v\n%s", name, r, debug.Stack()))
+			kind, err = Panicked, fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return Exited, fn(ctx)
+}
+
+func (s *Supervisor) setRunning(name string, running bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.children[name]; ok {
+		c.status.Running = running
+		if running {
+			c.status.StartedAt = time.Now()
+		}
+	}
+}
+
+// forget drops a child that is no longer supervised, unless it was replaced in the meantime.
+func (s *Supervisor) forget(name string, c *child) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.children[name] != c {
+		return
+	}
+	delete(s.children, name)
+	metrics.SupervisorCrashLooping.DeleteLabelValues(name)
+}
+
+// Status returns the status of a child.
+func (s *Supervisor) Status(name string) (Status, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.children[name]
+	if !ok {
+		return Status{}, false
+	}
+	return c.status, true
+}
+
+// Statuses returns the status of every child sorted by name.
+func (s *Supervisor) Statuses() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]Status, 0, len(s.children))
+	for _, c := range s.children {
+		statuses = append(statuses, c.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
@@ -4,166 +4,412 @@ import (
 	"common/config"
 	"common/pkg/log"
 	"common/pkg/rabbitmq"
+	"common/pkg/retry"
 	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-	"upbit/internal/domain"
-	"upbit/internal/ws/token"
+	"upbit/internal/exchange"
+	"upbit/internal/metrics"
+	"upbit/internal/orderbook"
 )
 
 type ConnectionManager struct {
 	Ctx       context.Context
 	Cancel    context.CancelFunc
-	WsURL     string
-	Token     domain.Token
+	Exchange  exchange.Exchange
 	Platform  string
+	DataTypes []string
 	WebSocket *websocket.Conn
 	Cfg       *config.Config
 	RP        *rabbitmq.Producer
+	Books     *orderbook.Books
+	Shard     int
+	// IdleTimeout forces a reconnect when no market data arrives for that long,
+	// zero falls back to the configured default.
+	IdleTimeout time.Duration
+	// Sinks are queues published to instead of the market data exchange.
+	Sinks []string
+	// OnReconnect is called with the cause before every reconnect.
+	OnReconnect func(err error)
+	// Pipeline publishes the messages read, without it they are published by the reader.
+	Pipeline *Pipeline
+
+	source    MarketSource
+	writeMu   sync.Mutex
+	marketsMu sync.Mutex
+	markets   []exchange.Subscription
+	resyncNow chan struct{}
+
+	sm          *stateMachine
+	stale       atomic.Bool
+	lastMessage atomic.Int64
 }
 
-func NewConnectionManager(ctx context.Context, url string, platform string, cfg *config.Config, rp *rabbitmq.Producer) *ConnectionManager {
+// NewConnectionManager creates a manager streaming the given data types over a
+// single connection, messages are demultiplexed into their queues by type.
+// A nil source subscribes to every market the exchange lists.
+func NewConnectionManager(ctx context.Context, ex exchange.Exchange, dataTypes []string, source MarketSource, cfg *config.Config, rp *rabbitmq.Producer) *ConnectionManager {
+	if source == nil {
+		source = ex.Markets
+	}
 	return &ConnectionManager{
-		Ctx:      ctx,
-		WsURL:    url,
-		Platform: platform,
-		Cfg:      cfg,
-		RP:       rp,
+		Ctx:       ctx,
+		Exchange:  ex,
+		Platform:  ex.Name(),
+		DataTypes: dataTypes,
+		Cfg:       cfg,
+		RP:        rp,
+		Books:     orderbook.NewBooks(),
+
+		source:    source,
+		resyncNow: make(chan struct{}, 1),
+		sm:        newStateMachine(),
 	}
 }
 
-func (cm *ConnectionManager) StartManager(ctx context.Context, wsURL string, token domain.Token, platform string, dataType string, restartChan chan<- string) {
-	cm.Ctx = ctx
-	cm.WsURL = wsURL
-	cm.Token = token
-	cm.Platform = platform
-	cm.startConnection(restartChan, dataType)
+// Run streams until the manager's context is cancelled. It returns an error once
+// the reconnect policy gives up. The context argument is only there to fit
+// supervisor.Go, which is handed the manager's own context.
+func (cm *ConnectionManager) Run(context.Context) (err error) {
+	cm.resetState()
+	defer func() { cm.setState(StateStopped, err) }()
+	return cm.connectAndHandle()
 }
 
-func (cm *ConnectionManager) WebSocketIsConnected() bool {
-	return cm.WebSocket != nil && cm.WebSocket.UnderlyingConn() != nil && cm.WebSocket.UnderlyingConn().RemoteAddr() != nil
+// DataType returns the data types of the manager joined by commas, as used in the control API.
+func (cm *ConnectionManager) DataType() string {
+	return strings.Join(cm.DataTypes, ",")
 }
 
-func (cm *ConnectionManager) startConnection(restartChan chan<- string, dataType string) {
-	for {
-		select {
-		case <-cm.Ctx.Done():
-			return
-		default:
-			// If connection closed, sending the signal to reconnect
-			cm.connectAndHandle(restartChan, dataType)
-		}
-	}
+// Stale reports whether the connection was dropped for staying idle and has not
+// delivered data since.
+func (cm *ConnectionManager) Stale() bool {
+	return cm.stale.Load()
 }
 
-func (cm *ConnectionManager) connectAndHandle(restartChan chan<- string, dataType string) {
-	backoff := 1
-	maxBackoff := 120
-	var queue string
-	if "ticker" == dataType {
-		queue = "ticker_queue"
-	} else if "trade" == dataType {
-		queue = "trade_queue"
-	} else {
-		log.Logger.Info("Unknown data type: " + dataType)
-		return
+// LastMessage returns when the last market data message was read, zero if none was.
+func (cm *ConnectionManager) LastMessage() time.Time {
+	nanos := cm.lastMessage.Load()
+	if nanos == 0 {
+		return time.Time{}
 	}
+	return time.Unix(0, nanos)
+}
+
+// Target names the connection in logs, metrics and the supervisor.
+func (cm *ConnectionManager) Target() string {
+	return fmt.Sprintf("%s/%s/%d", cm.Platform, cm.DataType(), cm.Shard)
+}
+
+// connectAndHandle keeps the connection up until the context is cancelled. It
+// returns an error once the reconnect policy gives up.
+func (cm *ConnectionManager) connectAndHandle() error {
+	backoff := retry.NewBackoff(cm.Cfg.WebSocket.Reconnect)
+	backoff.OnRetry = metrics.ObserveReconnect("websocket", cm.Target())
 
 	for {
 		select {
 		case <-cm.Ctx.Done():
 			log.Logger.Info("Context cancelled, stopping connection attempts")
+			cm.setState(StateStopping, nil)
 			if cm.WebSocket != nil {
 				if err := cm.WebSocket.Close(); err != nil {
 					log.Logger.Error("Error closing WebSocket", zap.Error(err))
 				}
 			}
-			return
+			return nil
 		default:
-			ws, err := WebsocketConnect(cm.WsURL, cm.Token)
-			if err != nil {
-				log.Logger.Error("Failed to connect: retrying...", zap.Error(err))
-				if backoff < maxBackoff {
-					backoff *= 2
-				}
-				continue
+		}
+
+		cm.setState(StateDialing, nil)
+		ws, err := WebsocketConnect(cm.Ctx, cm.Exchange, cm.DataTypes)
+		if err != nil {
+			log.Logger.Error("Failed to connect: retrying...", zap.Error(err))
+			cm.setState(StateBackingOff, err)
+			cm.reconnecting(err)
+			if err := cm.wait(backoff); err != nil {
+				return err
 			}
-			cm.WebSocket = ws
-			cm.sendRequest(dataType, cm.Platform)
-			cm.handleMessages(ws, queue)
-			// Reset backoff after a successful connection
-			backoff = 1
-			// If connection closed, sending the signal to reconnect
-			log.Logger.Info("Connection closed, signaling for reconnect")
-			restartChan <- dataType
+			continue
+		}
+		cm.WebSocket = ws
+		cause := cm.serve(ws, backoff)
+		if cm.Ctx.Err() != nil {
+			cm.setState(StateStopping, nil)
+			return nil
+		}
+		log.Logger.Info(fmt.Sprintf("Connection %s closed, reconnecting", cm.Target()))
+		cm.setState(StateBackingOff, cause)
+		cm.reconnecting(cause)
+
+		if err := cm.wait(backoff); err != nil {
+			return err
 		}
 	}
 }
 
-func (cm *ConnectionManager) handleMessages(ws *websocket.Conn, queue string) {
+// serve subscribes on a new connection and reads it until it fails. The
+// connection and its helpers are torn down on the way out, panics included, so
+// that a restarted manager starts from a clean slate.
+func (cm *ConnectionManager) serve(ws *websocket.Conn, backoff *retry.Backoff) error {
+	defer func() {
+		if err := ws.Close(); err != nil {
+			log.Logger.Debug("Error closing WebSocket", zap.Error(err))
+		}
+	}()
+
+	cm.setState(StateSubscribing, nil)
+	if err := cm.sendRequest(ws); err != nil {
+		log.Logger.Error("Failed to subscribe", zap.Error(err))
+		return err
+	}
+	backoff.Connected()
+	defer backoff.Disconnected()
+
+	// Stopped in reverse order, the close on cancel first and the heartbeat last.
+	defer cm.startHeartbeat(ws)()
+	defer cm.startKeepalive(ws)()
+	defer cm.limitLifetime(ws)()
+	defer cm.startMarketResync(ws)()
+	defer cm.closeOnCancel(ws)()
+
+	cm.setState(StateStreaming, nil)
+	return cm.handleMessages(ws)
+}
+
+func (cm *ConnectionManager) reconnecting(cause error) {
+	if cm.OnReconnect != nil {
+		cm.OnReconnect(cause)
+	}
+}
+
+// wait sleeps until the next attempt is due. Cancellation is not an error.
+func (cm *ConnectionManager) wait(backoff *retry.Backoff) error {
+	err := backoff.Wait(cm.Ctx)
+	if err != nil && cm.Ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// handleMessages reads until the connection fails and returns the read error.
+func (cm *ConnectionManager) handleMessages(ws *websocket.Conn) error {
 
 	for {
 		_, message, err := ws.ReadMessage()
 		if err != nil {
+			if cm.Ctx.Err() != nil {
+				return nil
+			}
 			log.Logger.Error("Failed to read a message", zap.Error(err))
-			break // or handle the error as needed
+			return err
 		}
+		cm.extendReadDeadline(ws)
 
-		// Вывод полученного сообщения в консоль
-		//fmt.Printf("Received message for queue %s: %s\n", queue, string(message))
-
-		if cm.RP != nil {
-			if err := cm.RP.SendMessage(queue, string(message)); err != nil {
-				log.Logger.Error("Failed to send message to queue "+queue, zap.Error(err))
+		msgs, err := cm.Exchange.Decode(message)
+		if err != nil {
+			log.Logger.Error(fmt.Sprintf("Failed to decode %s message", cm.Platform), zap.Error(err))
+		}
+		if len(msgs) > 0 {
+			cm.lastMessage.Store(time.Now().UnixNano())
+			cm.setStale(false)
+		}
+		for _, msg := range msgs {
+			cm.publish(msg)
+			if msg.Book != nil {
+				cm.applyBook(msg)
 			}
-		} else {
-			log.Logger.Error("Producer is nil")
 		}
 
 		select {
 		case <-cm.Ctx.Done():
 			log.Logger.Info("Context cancelled, stopping message handling")
-			return
+			return nil
 		default:
 		}
 	}
 }
 
-func (cm *ConnectionManager) sendRequest(dataType string, platform string) {
-	if cm.WebSocket == nil {
-		log.Logger.Info("WebSocket connection is nil")
+func (cm *ConnectionManager) publish(msg exchange.Message) {
+	if cm.Pipeline != nil {
+		cm.Pipeline.Push(msg, cm.Sinks)
 		return
 	}
-	upBitMarkets := []string{"KRW-BTC", "KRW-ETH", "KRW-NEO", "KRW-MTL", "KRW-XRP", "KRW-ETC", "KRW-SNT", "KRW-WAVES", "KRW-XEM", "KRW-QTUM", "KRW-LSK", "KRW-STEEM", "KRW-XLM", "KRW-ARDR", "KRW-ARK", "KRW-STORJ", "KRW-GRS", "KRW-ADA", "KRW-SBD", "KRW-POWR", "KRW-BTG", "KRW-ICX", "KRW-EOS", "KRW-TRX", "KRW-SC", "KRW-ONT", "KRW-ZIL", "KRW-POLYX", "KRW-ZRX", "KRW-LOOM", "KRW-BCH", "KRW-BAT", "KRW-IOST", "KRW-CVC", "KRW-IQ", "KRW-IOTA", "KRW-HIFI", "KRW-ONG", "KRW-GAS", "KRW-UPP", "KRW-ELF", "KRW-KNC", "KRW-BSV", "KRW-THETA", "KRW-QKC", "KRW-BTT", "KRW-MOC", "KRW-TFUEL", "KRW-MANA", "KRW-ANKR", "KRW-AERGO", "KRW-ATOM", "KRW-TT", "KRW-CRE", "KRW-MBL", "KRW-WAXP", "KRW-HBAR", "KRW-MED", "KRW-MLK", "KRW-STPT", "KRW-ORBS", "KRW-VET", "KRW-CHZ", "KRW-STMX", "KRW-DKA", "KRW-HIVE", "KRW-KAVA", "KRW-AHT", "KRW-LINK", "KRW-XTZ", "KRW-BORA", "KRW-JST", "KRW-CRO", "KRW-TON", "KRW-SXP", "KRW-HUNT", "KRW-PLA", "KRW-DOT", "KRW-MVL", "KRW-STRAX", "KRW-AQT", "KRW-GLM", "KRW-SSX", "KRW-META", "KRW-FCT2", "KRW-CBK", "KRW-SAND", "KRW-HPO", "KRW-DOGE", "KRW-STRK", "KRW-PUNDIX", "KRW-FLOW", "KRW-AXS", "KRW-STX", "KRW-XEC", "KRW-SOL", "KRW-MATIC", "KRW-AAVE", "KRW-1INCH", "KRW-ALGO", "KRW-NEAR", "KRW-AVAX", "KRW-T", "KRW-CELO", "KRW-GMT", "KRW-APT", "KRW-SHIB", "KRW-MASK", "KRW-ARB", "KRW-EGLD", "KRW-SUI", "KRW-GRT", "KRW-BLUR", "KRW-IMX", "KRW-SEI", "KRW-MINA"}
-	var request []byte
-	switch dataType {
-	case "ticker":
-		request = tickerRequest(platform, upBitMarkets)
-	case "trade":
-		request = tradeRequest(platform, upBitMarkets)
-	}
-	if platform == "binance" {
+	send(cm.RP, cm.Platform, msg, cm.Sinks)
+}
+
+// topOfBook is published with the orderbook data whenever the best bid or ask changes.
+type topOfBook struct {
+	Type     string `json:"type"`
+	Platform string `json:"platform"`
+	orderbook.TopOfBook
+}
+
+func (cm *ConnectionManager) applyBook(msg exchange.Message) {
+	top, changed := cm.Books.Apply(*msg.Book)
+	if !changed {
 		return
 	}
-	err := cm.WebSocket.WriteMessage(websocket.TextMessage, request)
+	body, err := json.Marshal(topOfBook{Type: "top_of_book", Platform: cm.Platform, TopOfBook: top})
 	if err != nil {
-		log.Logger.Error("Failed to write to websocket", zap.Error(err))
+		log.Logger.Error("Failed to encode top of book", zap.Error(err))
 		return
 	}
+	cm.publish(exchange.Message{Type: msg.Type, Market: msg.Market, Body: body})
+}
+
+func (cm *ConnectionManager) sendRequest(ws *websocket.Conn) error {
+	subs, err := cm.subscriptions()
+	if err != nil {
+		return err
+	}
+	cm.setMarkets(subs)
+	if len(subs) == 0 {
+		// Nothing assigned to this connection yet, the resync subscribes later.
+		return nil
+	}
+	frames, err := cm.Exchange.Subscribe(subs)
+	if err != nil {
+		return err
+	}
+	return cm.writeFrames(ws, frames)
+}
+
+func (cm *ConnectionManager) writeFrames(ws *websocket.Conn, frames [][]byte) error {
+	for _, frame := range frames {
+		if err := cm.write(ws, websocket.TextMessage, frame); err != nil {
+			return fmt.Errorf("failed to write to websocket: %v", err)
+		}
+	}
+	return nil
 }
 
-func WebsocketConnect(url string, t domain.Token) (*websocket.Conn, error) {
-	header := http.Header{}
-	header.Add("Authorization", "Bearer "+token.CreateToken(t))
+// startKeepalive sends the exchange keepalive frame until the returned func is
+// called, which waits for the last one to be written.
+func (cm *ConnectionManager) startKeepalive(ws *websocket.Conn) func() {
+	interval, frame := cm.Exchange.Keepalive()
+	if interval <= 0 || frame == nil {
+		return func() {}
+	}
+
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := cm.write(ws, websocket.TextMessage, frame); err != nil {
+					log.Logger.Error("Failed to send keepalive", zap.Error(err))
+				}
+			}
+		}
+	}()
+	return stopper(done, exited)
+}
+
+// limitLifetime closes the connection before the exchange drops it, so that the
+// reconnect happens at a moment of our choosing.
+func (cm *ConnectionManager) limitLifetime(ws *websocket.Conn) func() {
+	l, ok := cm.Exchange.(exchange.Lifetime)
+	if !ok {
+		return func() {}
+	}
+
+	fired := make(chan struct{})
+	timer := time.AfterFunc(l.MaxLifetime(), func() {
+		defer close(fired)
+		log.Logger.Info(fmt.Sprintf("%s connection reached its maximum lifetime, reconnecting", cm.Platform))
+		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "lifetime exceeded")
+		if err := cm.write(ws, websocket.CloseMessage, msg); err != nil {
+			log.Logger.Error("Failed to send close frame", zap.Error(err))
+		}
+		if err := ws.Close(); err != nil {
+			log.Logger.Error("Error closing WebSocket", zap.Error(err))
+		}
+	})
+	return func() {
+		if !timer.Stop() {
+			<-fired
+		}
+	}
+}
+
+// closeOnCancel says goodbye with a close frame once the context is cancelled and
+// closes the socket when the peer does not answer within closeGrace, so that
+// stopping never waits for the read deadline.
+func (cm *ConnectionManager) closeOnCancel(ws *websocket.Conn) func() {
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-done:
+			return
+		case <-cm.Ctx.Done():
+		}
+		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "shutting down")
+		if err := ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait)); err != nil {
+			log.Logger.Debug("Failed to send close frame", zap.Error(err))
+		}
+		select {
+		case <-done:
+		case <-time.After(closeGrace):
+			if err := ws.Close(); err != nil {
+				log.Logger.Debug("Error closing WebSocket", zap.Error(err))
+			}
+		}
+	}()
+	return stopper(done, exited)
+}
+
+// stopper returns the stop func of a helper goroutine: it closes done and waits
+// for the goroutine to close exited, so that nothing it does outlives the
+// connection it was started for.
+func stopper(done, exited chan struct{}) func() {
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// write serializes writes to ws, gorilla/websocket supports a single concurrent
+// writer. The socket is passed in rather than read from the manager so that a
+// helper of a closed connection never writes to its successor.
+func (cm *ConnectionManager) write(ws *websocket.Conn, messageType int, data []byte) error {
+	cm.writeMu.Lock()
+	defer cm.writeMu.Unlock()
+	if err := ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+		return err
+	}
+	return ws.WriteMessage(messageType, data)
+}
+
+// WebsocketConnect dials the exchange, giving up once ctx is done so that a
+// stopped stream does not wait for a hanging handshake.
+func WebsocketConnect(ctx context.Context, ex exchange.Exchange, dataTypes []string) (*websocket.Conn, error) {
+	url, header, err := ex.Dial(dataTypes)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		header = http.Header{}
+	}
 
 	dialer := *websocket.DefaultDialer
 	dialer.HandshakeTimeout = 10 * time.Second
 	dialer.WriteBufferSize = 1024
 	dialer.ReadBufferSize = 1024
 
-	ws, _, err := websocket.DefaultDialer.Dial(url, header)
-
+	ws, _, err := dialer.DialContext(ctx, url, header)
 	return ws, err
 }
@@ -0,0 +1,148 @@
+package ws
+
+import (
+	"common/pkg/log"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"strconv"
+	"time"
+	"upbit/internal/metrics"
+)
+
+const (
+	defaultPingInterval = 30 * time.Second
+	defaultPongTimeout  = 75 * time.Second
+	writeWait           = 10 * time.Second
+	// closeGrace is how long a closing peer gets to answer our close frame.
+	closeGrace = time.Second
+)
+
+var errIdleTimeout = errors.New("idle timeout")
+
+func (cm *ConnectionManager) pongTimeout() time.Duration {
+	if cm.Cfg.WebSocket.PongTimeout > 0 {
+		return cm.Cfg.WebSocket.PongTimeout
+	}
+	return defaultPongTimeout
+}
+
+func (cm *ConnectionManager) idleTimeout() time.Duration {
+	if cm.IdleTimeout > 0 {
+		return cm.IdleTimeout
+	}
+	return cm.Cfg.WebSocket.IdleTimeout
+}
+
+// extendReadDeadline gives the peer another pong timeout to send anything. A
+// half-open connection fails the next read instead of blocking forever.
+func (cm *ConnectionManager) extendReadDeadline(ws *websocket.Conn) {
+	if err := ws.SetReadDeadline(time.Now().Add(cm.pongTimeout())); err != nil {
+		log.Logger.Debug("Failed to set read deadline", zap.Error(err))
+	}
+}
+
+// startHeartbeat pings the peer, answers its pings and drops the connection when
+// either the peer or the feed goes silent, until the returned func is called.
+func (cm *ConnectionManager) startHeartbeat(ws *websocket.Conn) func() {
+	cm.extendReadDeadline(ws)
+	ws.SetPongHandler(func(string) error {
+		cm.extendReadDeadline(ws)
+		return nil
+	})
+	ws.SetPingHandler(func(data string) error {
+		cm.extendReadDeadline(ws)
+		err := ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeWait))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+
+	pingInterval := cm.Cfg.WebSocket.PingInterval
+	if pingInterval <= 0 {
+		pingInterval = defaultPingInterval
+	}
+	idleTimeout := cm.idleTimeout()
+	connectedAt := time.Now()
+
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		ping := time.NewTicker(pingInterval)
+		defer ping.Stop()
+
+		var idle <-chan time.Time
+		if idleTimeout > 0 {
+			check := time.NewTicker(idleTimeout / 4)
+			defer check.Stop()
+			idle = check.C
+		}
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ping.C:
+				if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+					log.Logger.Error(fmt.Sprintf("Failed to ping %s", cm.Target()), zap.Error(err))
+				}
+			case <-idle:
+				if !cm.subscribedToMarkets() {
+					// Nothing or only event-driven channels subscribed, such as
+					// myOrder or myAsset of a quiet account. Silence is expected.
+					continue
+				}
+				last := cm.LastMessage()
+				if last.Before(connectedAt) {
+					last = connectedAt
+				}
+				if time.Since(last) < idleTimeout {
+					continue
+				}
+				log.Logger.Error(fmt.Sprintf("No data from %s for %s, reconnecting", cm.Target(), time.Since(last).Round(time.Second)))
+				cm.setStale(true)
+				msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, errIdleTimeout.Error())
+				_ = ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+				if err := ws.Close(); err != nil {
+					log.Logger.Debug("Error closing WebSocket", zap.Error(err))
+				}
+				return
+			}
+		}
+	}()
+	return stopper(done, exited)
+}
+
+// subscribedToMarkets reports whether the connection carries market data. Only
+// then is silence a sign of a dead feed, channels without markets send nothing
+// until an event happens.
+func (cm *ConnectionManager) subscribedToMarkets() bool {
+	for _, sub := range cm.Markets() {
+		if len(sub.Markets) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// setStale flags a feed that went silent, it is cleared by the next data message.
+func (cm *ConnectionManager) setStale(stale bool) {
+	if cm.stale.Swap(stale) == stale {
+		return
+	}
+	if stale {
+		cm.setState(StateStale, errIdleTimeout)
+	} else {
+		cm.setState(StateStreaming, nil)
+	}
+	if cm.Ctx.Err() != nil {
+		return
+	}
+	value := 0.0
+	if stale {
+		value = 1
+	}
+	metrics.ShardStale.WithLabelValues(cm.Platform, cm.DataType(), strconv.Itoa(cm.Shard)).Set(value)
+}
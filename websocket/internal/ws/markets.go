@@ -0,0 +1,123 @@
+package ws
+
+import (
+	"common/pkg/log"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"time"
+	"upbit/internal/exchange"
+)
+
+const defaultMarketResync = time.Minute
+
+// Markets returns the current subscription of every data type.
+func (cm *ConnectionManager) Markets() []exchange.Subscription {
+	cm.marketsMu.Lock()
+	defer cm.marketsMu.Unlock()
+
+	subs := make([]exchange.Subscription, len(cm.markets))
+	for i, sub := range cm.markets {
+		subs[i] = exchange.Subscription{DataType: sub.DataType, Markets: append([]string(nil), sub.Markets...)}
+	}
+	return subs
+}
+
+func (cm *ConnectionManager) requestResync() {
+	select {
+	case cm.resyncNow <- struct{}{}:
+	default:
+	}
+}
+
+// subscriptions loads the markets of every data type from the market source.
+// Data types left without markets are not subscribed.
+func (cm *ConnectionManager) subscriptions() ([]exchange.Subscription, error) {
+	subs := make([]exchange.Subscription, 0, len(cm.DataTypes))
+	for _, dataType := range cm.DataTypes {
+		markets, err := cm.source(cm.Ctx, dataType)
+		if err != nil {
+			return nil, err
+		}
+		if markets != nil && len(markets) == 0 {
+			continue
+		}
+		subs = append(subs, exchange.Subscription{DataType: dataType, Markets: markets})
+	}
+	return subs, nil
+}
+
+func (cm *ConnectionManager) setMarkets(subs []exchange.Subscription) {
+	cm.marketsMu.Lock()
+	defer cm.marketsMu.Unlock()
+
+	cm.markets = subs
+}
+
+// startMarketResync compares the market source with the live subscription
+// periodically, or right away when requested, until the returned func is
+// called. Stopping waits for a resync in flight, which would otherwise record
+// the markets of a closed connection over those of its successor.
+func (cm *ConnectionManager) startMarketResync(ws *websocket.Conn) func() {
+	interval := cm.Cfg.WebSocket.MarketResync
+	if interval <= 0 {
+		interval = defaultMarketResync
+	}
+
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-cm.Ctx.Done():
+				return
+			case <-ticker.C:
+			case <-cm.resyncNow:
+			}
+			if err := cm.resyncMarkets(ws); err != nil {
+				log.Logger.Error(fmt.Sprintf("Failed to resync %s %s markets", cm.Platform, cm.DataType()), zap.Error(err))
+			}
+		}
+	}()
+	return stopper(done, exited)
+}
+
+func (cm *ConnectionManager) resyncMarkets(ws *websocket.Conn) error {
+	subs, err := cm.subscriptions()
+	if err != nil {
+		return err
+	}
+
+	previous := cm.Markets()
+	changed := len(subs) != len(previous)
+	for _, sub := range subs {
+		added, removed := exchange.Diff(exchange.Find(previous, sub.DataType), sub.Markets)
+		if len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+		changed = true
+		log.Logger.Info(fmt.Sprintf("%s %s shard %d subscription changed: %d added, %d removed", cm.Platform, sub.DataType, cm.Shard, len(added), len(removed)))
+	}
+	if !changed {
+		return nil
+	}
+
+	r, ok := cm.Exchange.(exchange.Resubscriber)
+	if !ok || len(subs) == 0 {
+		// The reconnect subscribes to the new lists.
+		return ws.Close()
+	}
+	frames, err := r.Resubscribe(previous, subs)
+	if err != nil {
+		return err
+	}
+	if err := cm.writeFrames(ws, frames); err != nil {
+		return err
+	}
+	cm.setMarkets(subs)
+	return nil
+}
@@ -0,0 +1,305 @@
+package ws
+
+import (
+	"common/config"
+	"common/pkg/log"
+	"common/pkg/rabbitmq"
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/streadway/amqp"
+	"go.uber.org/zap"
+	"hash/fnv"
+	"sync"
+	"upbit/internal/exchange"
+	"upbit/internal/metrics"
+)
+
+// Overflow policies of a pipeline, applied when a worker queue is full.
+const (
+	// OverflowBlock makes the reader wait for room.
+	OverflowBlock = "block"
+	// OverflowDropOldest drops the oldest queued message.
+	OverflowDropOldest = "drop-oldest"
+	// OverflowConflate replaces a queued ticker with the latest one of its market
+	// and kind, and blocks like OverflowBlock when that does not make room.
+	OverflowConflate = "conflate"
+)
+
+const (
+	defaultPipelineWorkers    = 4
+	defaultPipelineBufferSize = 10000
+)
+
+type delivery struct {
+	msg   exchange.Message
+	sinks []string
+}
+
+// conflatable reports whether a newer message of the same key supersedes d.
+func (d *delivery) conflatable() bool {
+	return d.msg.Type == "ticker" && d.msg.Market != ""
+}
+
+// key identifies the tickers that supersede each other: those of one market and
+// kind, so that a Binance miniTicker never replaces a bookTicker.
+func (d *delivery) key() string {
+	return d.msg.Market + "\x00" + d.msg.Kind
+}
+
+// metricOwners records which pipeline or stream last took the metric labels of
+// a platform and data type. One stopped after its stream was started again
+// leaves the series of its successor alone.
+type metricOwners struct {
+	mu     sync.Mutex
+	owners map[string]any
+}
+
+var (
+	pipelineMetrics = &metricOwners{owners: make(map[string]any)}
+	shardMetrics    = &metricOwners{owners: make(map[string]any)}
+)
+
+// claim makes owner the holder of the labels and runs fn, which sets up its
+// series, while no other claim or release runs.
+func (m *metricOwners) claim(platform, dataType string, owner any, fn func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.owners[platform+"/"+dataType] = owner
+	fn()
+}
+
+// release runs fn, which deletes the series, unless the labels were claimed
+// by another owner since.
+func (m *metricOwners) release(platform, dataType string, owner any, fn func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.owners[platform+"/"+dataType] != owner {
+		return
+	}
+	delete(m.owners, platform+"/"+dataType)
+	fn()
+}
+
+// Pipeline decouples reading a stream from publishing it. Messages are queued
+// per worker, each market always going to the same worker, so a slow broker
+// backs up the queues instead of the socket reads while every market keeps
+// its order.
+type Pipeline struct {
+	platform string
+	dataType string
+	policy   string
+	rp       *rabbitmq.Producer
+
+	workers []*pipelineWorker
+	wg      sync.WaitGroup
+
+	depth     prometheus.Gauge
+	dropped   prometheus.Counter
+	conflated prometheus.Counter
+}
+
+type pipelineWorker struct {
+	p *Pipeline
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	capacity int
+	queue    []*delivery
+	// latest points at the queued ticker of each market and kind, for conflation.
+	latest map[string]*delivery
+	closed bool
+}
+
+// NewPipeline starts the publisher workers of a stream.
+func NewPipeline(platform, dataType string, cfg *config.Config, rp *rabbitmq.Producer) *Pipeline {
+	opts := cfg.WebSocket.Pipeline
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = defaultPipelineWorkers
+	}
+	size := opts.BufferSize
+	if size <= 0 {
+		size = defaultPipelineBufferSize
+	}
+	policy := opts.Overflow
+	switch policy {
+	case OverflowBlock, OverflowDropOldest, OverflowConflate:
+	case "":
+		policy = OverflowBlock
+	default:
+		log.Logger.Error(fmt.Sprintf("Unknown pipeline overflow policy %q, blocking instead", policy))
+		policy = OverflowBlock
+	}
+
+	p := &Pipeline{
+		platform: platform,
+		dataType: dataType,
+		policy:   policy,
+		rp:       rp,
+	}
+	pipelineMetrics.claim(platform, dataType, p, func() {
+		// A predecessor still draining keeps counting on the series it holds.
+		p.deleteMetrics()
+		p.depth = metrics.PipelineDepth.WithLabelValues(platform, dataType)
+		p.dropped = metrics.PipelineDropped.WithLabelValues(platform, dataType, "overflow")
+		p.conflated = metrics.PipelineDropped.WithLabelValues(platform, dataType, "conflated")
+	})
+	// The buffer is split between the workers, each keeps at least one message.
+	capacity := size / workers
+	if capacity < 1 {
+		capacity = 1
+	}
+	for i := 0; i < workers; i++ {
+		w := &pipelineWorker{p: p, capacity: capacity, latest: make(map[string]*delivery)}
+		w.cond = sync.NewCond(&w.mu)
+		p.workers = append(p.workers, w)
+		p.wg.Add(1)
+		go w.run()
+	}
+	return p
+}
+
+// Push queues a message for its sinks, none meaning the market data exchange.
+// When the queue of the market is full it waits for room or drops the oldest
+// message, depending on the overflow policy. With OverflowConflate a ticker
+// replaces the queued one of its market and kind instead of queueing behind it.
+// Messages pushed after Close are discarded.
+func (p *Pipeline) Push(msg exchange.Message, sinks []string) {
+	h := fnv.New32a()
+	h.Write([]byte(msg.Market))
+	w := p.workers[h.Sum32()%uint32(len(p.workers))]
+	w.push(&delivery{msg: msg, sinks: sinks})
+}
+
+// Depth returns the number of queued messages.
+func (p *Pipeline) Depth() int {
+	depth := 0
+	for _, w := range p.workers {
+		w.mu.Lock()
+		depth += len(w.queue)
+		w.mu.Unlock()
+	}
+	return depth
+}
+
+// Close stops taking messages and waits for the workers to hand the queued ones
+// to the producer, or until ctx is done. The workers keep draining in the
+// background when ctx ends first.
+func (p *Pipeline) Close(ctx context.Context) error {
+	for _, w := range p.workers {
+		w.mu.Lock()
+		w.closed = true
+		w.cond.Broadcast()
+		w.mu.Unlock()
+	}
+	defer pipelineMetrics.release(p.platform, p.dataType, p, p.deleteMetrics)
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d messages of %s %s were not published: %w", p.Depth(), p.platform, p.dataType, ctx.Err())
+	}
+}
+
+func (p *Pipeline) deleteMetrics() {
+	metrics.PipelineDepth.DeleteLabelValues(p.platform, p.dataType)
+	metrics.PipelineDropped.DeleteLabelValues(p.platform, p.dataType, "overflow")
+	metrics.PipelineDropped.DeleteLabelValues(p.platform, p.dataType, "conflated")
+}
+
+func (w *pipelineWorker) push(d *delivery) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.p.policy == OverflowConflate && d.conflatable() {
+		if queued, ok := w.latest[d.key()]; ok {
+			// Keep the queued position, which is the market's place in line.
+			*queued = *d
+			w.p.conflated.Inc()
+			return
+		}
+	}
+	for len(w.queue) >= w.capacity && !w.closed {
+		if w.p.policy == OverflowDropOldest {
+			w.pop()
+			w.p.dropped.Inc()
+			continue
+		}
+		w.cond.Wait()
+	}
+	if w.closed {
+		return
+	}
+	w.queue = append(w.queue, d)
+	if d.conflatable() {
+		w.latest[d.key()] = d
+	}
+	w.p.depth.Inc()
+	w.cond.Broadcast()
+}
+
+// pop takes the oldest queued message, w.mu must be held.
+func (w *pipelineWorker) pop() *delivery {
+	d := w.queue[0]
+	w.queue[0] = nil
+	w.queue = w.queue[1:]
+	if w.latest[d.key()] == d {
+		delete(w.latest, d.key())
+	}
+	w.p.depth.Dec()
+	return d
+}
+
+func (w *pipelineWorker) run() {
+	defer w.p.wg.Done()
+	for {
+		w.mu.Lock()
+		for len(w.queue) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		if len(w.queue) == 0 {
+			w.mu.Unlock()
+			return
+		}
+		d := w.pop()
+		// Wake a reader waiting for room.
+		w.cond.Broadcast()
+		w.mu.Unlock()
+
+		send(w.p.rp, w.p.platform, d.msg, d.sinks)
+	}
+}
+
+// send publishes a message to each of its sinks, or to the market data exchange
+// when there are none.
+func send(rp *rabbitmq.Producer, platform string, msg exchange.Message, sinks []string) {
+	if rp == nil {
+		log.Logger.Error("Producer is nil")
+		return
+	}
+	var headers amqp.Table
+	if msg.Account != "" {
+		headers = amqp.Table{"account": msg.Account}
+	}
+	if len(sinks) == 0 {
+		key := rabbitmq.RoutingKey(platform, msg.Type, msg.Market)
+		if err := rp.SendRouted(key, string(msg.Body), headers); err != nil {
+			log.Logger.Error("Failed to send message as "+key, zap.Error(err))
+		}
+		return
+	}
+	for _, queue := range sinks {
+		if err := rp.SendMessageWithHeaders(queue, string(msg.Body), headers); err != nil {
+			log.Logger.Error("Failed to send message to queue "+queue, zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package ws
+
+import (
+	"common/config"
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"testing"
+	"time"
+	"upbit/internal/exchange"
+	"upbit/internal/metrics"
+)
+
+// idleWorker returns a worker of a conflating pipeline that does not publish,
+// so that the test sees what stays queued.
+func idleWorker(capacity int) *pipelineWorker {
+	p := &Pipeline{
+		policy:    OverflowConflate,
+		depth:     prometheus.NewGauge(prometheus.GaugeOpts{Name: "depth"}),
+		dropped:   prometheus.NewCounter(prometheus.CounterOpts{Name: "dropped"}),
+		conflated: prometheus.NewCounter(prometheus.CounterOpts{Name: "conflated"}),
+	}
+	w := &pipelineWorker{p: p, capacity: capacity, latest: make(map[string]*delivery)}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+func queued(w *pipelineWorker) []string {
+	var bodies []string
+	for _, d := range w.queue {
+		bodies = append(bodies, string(d.msg.Body))
+	}
+	return bodies
+}
+
+func TestConflate(t *testing.T) {
+	tests := []struct {
+		name string
+		msgs []exchange.Message
+		want []string
+	}{
+		{
+			name: "latest ticker of a market replaces the queued one in place",
+			msgs: []exchange.Message{
+				{Type: "ticker", Market: "KRW-BTC", Body: []byte("btc 1")},
+				{Type: "ticker", Market: "KRW-ETH", Body: []byte("eth 1")},
+				{Type: "ticker", Market: "KRW-BTC", Body: []byte("btc 2")},
+			},
+			want: []string{"btc 2", "eth 1"},
+		},
+		{
+			name: "binance bookTicker and miniTicker are kept apart",
+			msgs: []exchange.Message{
+				{Type: "ticker", Market: "BTCUSDT", Kind: "bookTicker", Body: []byte("book 1")},
+				{Type: "ticker", Market: "BTCUSDT", Kind: "miniTicker", Body: []byte("mini 1")},
+				{Type: "ticker", Market: "BTCUSDT", Kind: "bookTicker", Body: []byte("book 2")},
+			},
+			want: []string{"book 2", "mini 1"},
+		},
+		{
+			name: "bithumb tick types are kept apart",
+			msgs: []exchange.Message{
+				{Type: "ticker", Market: "BTC_KRW", Kind: "30M", Body: []byte("30M 1")},
+				{Type: "ticker", Market: "BTC_KRW", Kind: "1H", Body: []byte("1H 1")},
+				{Type: "ticker", Market: "BTC_KRW", Kind: "24H", Body: []byte("24H 1")},
+				{Type: "ticker", Market: "BTC_KRW", Kind: "MID", Body: []byte("MID 1")},
+				{Type: "ticker", Market: "BTC_KRW", Kind: "1H", Body: []byte("1H 2")},
+			},
+			want: []string{"30M 1", "1H 2", "24H 1", "MID 1"},
+		},
+		{
+			name: "trades are never conflated",
+			msgs: []exchange.Message{
+				{Type: "trade", Market: "KRW-BTC", Body: []byte("trade 1")},
+				{Type: "trade", Market: "KRW-BTC", Body: []byte("trade 2")},
+			},
+			want: []string{"trade 1", "trade 2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := idleWorker(len(tt.msgs))
+			for _, msg := range tt.msgs {
+				w.push(&delivery{msg: msg})
+			}
+			got := queued(w)
+			if len(got) != len(tt.want) {
+				t.Fatalf("queued %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("queued %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestConflateAfterPublish(t *testing.T) {
+	w := idleWorker(4)
+	w.push(&delivery{msg: exchange.Message{Type: "ticker", Market: "KRW-BTC", Body: []byte("btc 1")}})
+	// Once handed to the producer the ticker no longer takes replacements.
+	w.pop()
+	w.push(&delivery{msg: exchange.Message{Type: "ticker", Market: "KRW-BTC", Body: []byte("btc 2")}})
+	w.push(&delivery{msg: exchange.Message{Type: "ticker", Market: "KRW-BTC", Body: []byte("btc 3")}})
+
+	if got := queued(w); len(got) != 1 || got[0] != "btc 3" {
+		t.Fatalf("queued %q, want [btc 3]", got)
+	}
+}
+
+func TestConflateFullQueueBlocks(t *testing.T) {
+	w := idleWorker(1)
+	w.push(&delivery{msg: exchange.Message{Type: "ticker", Market: "KRW-BTC", Body: []byte("btc")}})
+
+	pushed := make(chan struct{})
+	go func() {
+		w.push(&delivery{msg: exchange.Message{Type: "ticker", Market: "KRW-ETH", Body: []byte("eth")}})
+		close(pushed)
+	}()
+	// A ticker of another market does not conflate, so it waits for room.
+	select {
+	case <-pushed:
+		t.Fatal("push did not wait for room")
+	case <-time.After(50 * time.Millisecond):
+	}
+	w.mu.Lock()
+	w.pop()
+	w.cond.Broadcast()
+	w.mu.Unlock()
+	<-pushed
+
+	if got := queued(w); len(got) != 1 || got[0] != "eth" {
+		t.Fatalf("queued %q, want [eth]", got)
+	}
+}
+
+func TestCloseKeepsSuccessorMetrics(t *testing.T) {
+	cfg := &config.Config{}
+	old := NewPipeline("test", "ticker", cfg, nil)
+	// The stream is started again before the old pipeline is closed.
+	p := NewPipeline("test", "ticker", cfg, nil)
+	if err := old.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if metrics.PipelineDepth.WithLabelValues("test", "ticker") != p.depth {
+		t.Fatal("closing the old pipeline deleted the depth of its successor")
+	}
+
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if metrics.PipelineDepth.WithLabelValues("test", "ticker") == p.depth {
+		t.Fatal("closing the pipeline kept its depth")
+	}
+	metrics.PipelineDepth.DeleteLabelValues("test", "ticker")
+}
@@ -0,0 +1,148 @@
+package ws
+
+import (
+	"common/pkg/log"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+	"upbit/internal/metrics"
+)
+
+// State is the lifecycle state of a connection manager.
+type State string
+
+const (
+	StateIdle        State = "idle"
+	StateDialing     State = "dialing"
+	StateSubscribing State = "subscribing"
+	StateStreaming   State = "streaming"
+	StateStale       State = "stale"
+	StateBackingOff  State = "backing-off"
+	StateStopping    State = "stopping"
+	StateStopped     State = "stopped"
+)
+
+// transitions lists the states each state may move to.
+var transitions = map[State][]State{
+	StateIdle:        {StateDialing, StateStopping, StateStopped},
+	StateDialing:     {StateSubscribing, StateBackingOff, StateStopping, StateStopped},
+	StateSubscribing: {StateStreaming, StateBackingOff, StateStopping, StateStopped},
+	StateStreaming:   {StateStale, StateBackingOff, StateStopping, StateStopped},
+	StateStale:       {StateStreaming, StateBackingOff, StateStopping, StateStopped},
+	StateBackingOff:  {StateDialing, StateStopping, StateStopped},
+	StateStopping:    {StateStopped},
+	// A manager that gave up is stopped and may be restarted by the supervisor.
+	StateStopped: {StateDialing},
+}
+
+// maxTransitions bounds the transition history kept per connection.
+const maxTransitions = 20
+
+// Transition records a state change and what caused it.
+type Transition struct {
+	From  State     `json:"from"`
+	To    State     `json:"to"`
+	At    time.Time `json:"at"`
+	Error string    `json:"error,omitempty"`
+}
+
+// StateInfo is the current state of a connection and its recent transitions, oldest first.
+type StateInfo struct {
+	State       State        `json:"state"`
+	Since       time.Time    `json:"since"`
+	Transitions []Transition `json:"transitions"`
+}
+
+type stateMachine struct {
+	mu      sync.Mutex
+	state   State
+	since   time.Time
+	history []Transition
+}
+
+func newStateMachine() *stateMachine {
+	return &stateMachine{state: StateIdle, since: time.Now()}
+}
+
+func canTransition(from, to State) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// State returns the current state of the connection.
+func (cm *ConnectionManager) State() StateInfo {
+	sm := cm.sm
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	return StateInfo{
+		State:       sm.state,
+		Since:       sm.since,
+		Transitions: append([]Transition(nil), sm.history...),
+	}
+}
+
+// Connected reports whether the manager is subscribed on a live connection.
+func (cm *ConnectionManager) Connected() bool {
+	state := cm.State().State
+	return state == StateStreaming || state == StateStale
+}
+
+// resetState stops a manager left mid-run, by a panic for instance, so that the
+// next run may dial again.
+func (cm *ConnectionManager) resetState() {
+	if state := cm.State().State; state != StateIdle && state != StateStopped {
+		cm.setState(StateStopped, fmt.Errorf("run ended in state %s", state))
+	}
+}
+
+// setState moves the connection to state. Transitions the state machine does
+// not allow are logged and ignored.
+func (cm *ConnectionManager) setState(state State, cause error) {
+	sm := cm.sm
+	sm.mu.Lock()
+	from := sm.state
+	// A stopping manager may still fail its last dial or read, it only moves on
+	// to stopped. A stopped one has nothing left to stop.
+	if from == state || (from == StateStopping && state != StateStopped) || (from == StateStopped && state == StateStopping) {
+		sm.mu.Unlock()
+		return
+	}
+	if !canTransition(from, state) {
+		sm.mu.Unlock()
+		log.Logger.Error(fmt.Sprintf("Invalid state transition of %s from %s to %s", cm.Target(), from, state))
+		return
+	}
+	now := time.Now()
+	t := Transition{From: from, To: state, At: now}
+	if cause != nil {
+		t.Error = cause.Error()
+	}
+	sm.state = state
+	sm.since = now
+	sm.history = append(sm.history, t)
+	if len(sm.history) > maxTransitions {
+		sm.history = sm.history[len(sm.history)-maxTransitions:]
+	}
+	sm.mu.Unlock()
+
+	log.Logger.Debug(fmt.Sprintf("%s %s -> %s", cm.Target(), from, state))
+	cm.updateConnectedMetric(state == StateStreaming || state == StateStale)
+}
+
+func (cm *ConnectionManager) updateConnectedMetric(connected bool) {
+	if cm.Ctx == nil || cm.Ctx.Err() != nil {
+		// The stream is stopped and its metrics are gone.
+		return
+	}
+	value := 0.0
+	if connected {
+		value = 1
+	}
+	metrics.ShardConnected.WithLabelValues(cm.Platform, cm.DataType(), strconv.Itoa(cm.Shard)).Set(value)
+}
@@ -0,0 +1,493 @@
+package ws
+
+import (
+	"common/config"
+	"common/pkg/log"
+	"common/pkg/rabbitmq"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"upbit/internal/exchange"
+	"upbit/internal/metrics"
+	"upbit/internal/supervisor"
+)
+
+const marketEventsQueue = "market_events_queue"
+
+var (
+	// ErrNoMarkets is returned by CheckMarkets for a stream whose data types do not take markets.
+	ErrNoMarkets = errors.New("stream does not take markets")
+	// ErrUnlisted is returned by CheckMarkets for markets the platform does not list.
+	ErrUnlisted = errors.New("markets are not listed")
+)
+
+type marketEvent struct {
+	Type     string    `json:"type"`
+	Platform string    `json:"platform"`
+	Market   string    `json:"market"`
+	Time     time.Time `json:"time"`
+}
+
+// MarketSource returns the markets a connection subscribes to for a data type.
+// A nil list means the data type does not take markets, an empty list means
+// the connection does not subscribe to it.
+type MarketSource func(ctx context.Context, dataType string) ([]string, error)
+
+// ShardHealth reports the state of one connection of a stream.
+type ShardHealth struct {
+	Shard int `json:"shard"`
+	StateInfo
+	Connected   bool      `json:"connected"`
+	Stale       bool      `json:"stale"`
+	Markets     int       `json:"markets"`
+	LastMessage time.Time `json:"lastMessage,omitempty"`
+
+	Supervisor supervisor.Status `json:"supervisor"`
+}
+
+// Stream streams the data types of one platform. Its market set is split into
+// shards of at most ShardSize markets, each served by its own connection so that
+// a dropped socket only gaps a slice of the markets. A ShardSize of zero keeps
+// every market on a single connection.
+type Stream struct {
+	Platform  string
+	DataTypes []string
+	ShardSize int
+	// IdleTimeout overrides the configured idle timeout of the stream's connections.
+	IdleTimeout time.Duration
+	// Pinned restricts the stream to these markets instead of the exchange market list.
+	Pinned []string
+	// Sinks are queues published to instead of the market data exchange.
+	Sinks []string
+	// StartedBy and StartedAt record who started the stream and when.
+	StartedBy string
+	StartedAt time.Time
+
+	ex  exchange.Exchange
+	cfg *config.Config
+	rp  *rabbitmq.Producer
+
+	sup *supervisor.Supervisor
+	ctx context.Context
+
+	mu        sync.Mutex
+	shards    []*ConnectionManager
+	effective map[string][]string
+	assigned  map[string]int
+	extra     map[string]bool
+	excluded  map[string]bool
+	pipeline  *Pipeline
+	// exited are closed once the connection manager of each shard returned.
+	exited []<-chan struct{}
+}
+
+func NewStream(ex exchange.Exchange, dataTypes []string, shardSize int, cfg *config.Config, rp *rabbitmq.Producer, sup *supervisor.Supervisor) *Stream {
+	return &Stream{
+		sup:       sup,
+		Platform:  ex.Name(),
+		DataTypes: dataTypes,
+		ShardSize: shardSize,
+		ex:        ex,
+		cfg:       cfg,
+		rp:        rp,
+		effective: make(map[string][]string),
+		assigned:  make(map[string]int),
+		extra:     make(map[string]bool),
+		excluded:  make(map[string]bool),
+	}
+}
+
+// DataType returns the data types of the stream joined by commas, as used in the control API.
+func (s *Stream) DataType() string {
+	return strings.Join(s.DataTypes, ",")
+}
+
+// Start runs the first shard, more shards are started once the market set outgrows it.
+func (s *Stream) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ctx = ctx
+	s.pipeline = NewPipeline(s.Platform, s.DataType(), s.cfg, s.rp)
+	// Series left by a predecessor with more shards are dropped.
+	shardMetrics.claim(s.Platform, s.DataType(), s, s.deleteShardMetrics)
+	s.addShard()
+}
+
+// addShard starts a new connection, s.mu must be held.
+func (s *Stream) addShard() {
+	shard := len(s.shards)
+	cm := NewConnectionManager(s.ctx, s.ex, s.DataTypes, s.shardSource(shard), s.cfg, s.rp)
+	cm.Shard = shard
+	cm.IdleTimeout = s.IdleTimeout
+	cm.Sinks = s.Sinks
+	cm.Pipeline = s.pipeline
+	cm.OnReconnect = func(err error) {
+		s.sup.Report(cm.Target(), supervisor.Disconnected, err)
+	}
+	s.shards = append(s.shards, cm)
+
+	if len(s.shards) > 1 {
+		log.Logger.Info(fmt.Sprintf("Starting shard %d of %s %s", shard, s.Platform, s.DataType()))
+	}
+	s.exited = append(s.exited, s.sup.Go(s.ctx, cm.Target(), cm.Run))
+}
+
+// shardSource returns the part of the market set assigned to a shard.
+func (s *Stream) shardSource(shard int) MarketSource {
+	return func(ctx context.Context, dataType string) ([]string, error) {
+		markets, err := s.resolve(ctx, dataType)
+		if err != nil {
+			return nil, err
+		}
+		if markets == nil {
+			// Channels without markets, like private ones, are carried by the first shard only.
+			if shard == 0 {
+				return nil, nil
+			}
+			return []string{}, nil
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.rebalance()
+		own := []string{}
+		for _, market := range markets {
+			if s.assigned[market] == shard {
+				own = append(own, market)
+			}
+		}
+		return own, nil
+	}
+}
+
+// resolve loads the exchange market list of a data type and applies the
+// per-market overrides.
+func (s *Stream) resolve(ctx context.Context, dataType string) ([]string, error) {
+	listed, err := s.ex.Markets(ctx, dataType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s %s markets: %v", s.Platform, dataType, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	markets := s.applyOverrides(s.pin(listed))
+	s.effective[dataType] = markets
+	return markets, nil
+}
+
+// pin swaps an exchange market list for the pinned markets. Data types without a
+// market list are left alone.
+func (s *Stream) pin(listed []string) []string {
+	if listed == nil || len(s.Pinned) == 0 {
+		return listed
+	}
+	return s.Pinned
+}
+
+// applyOverrides applies AddMarkets and RemoveMarkets to an exchange market list,
+// s.mu must be held. Data types without a market list are left alone.
+func (s *Stream) applyOverrides(listed []string) []string {
+	if listed == nil {
+		return nil
+	}
+
+	set := make(map[string]bool, len(listed)+len(s.extra))
+	for _, market := range listed {
+		set[market] = true
+	}
+	for market := range s.extra {
+		set[market] = true
+	}
+	markets := make([]string, 0, len(set))
+	for market := range set {
+		if !s.excluded[market] {
+			markets = append(markets, market)
+		}
+	}
+	sort.Strings(markets)
+	return markets
+}
+
+// rebalance keeps every market on the shard it was first assigned to and puts new
+// markets on the least loaded shard, starting a new one when all are full.
+// s.mu must be held.
+func (s *Stream) rebalance() {
+	all := make(map[string]bool)
+	for _, markets := range s.effective {
+		for _, market := range markets {
+			all[market] = true
+		}
+	}
+
+	load := make([]int, len(s.shards))
+	for market, shard := range s.assigned {
+		if !all[market] {
+			delete(s.assigned, market)
+			continue
+		}
+		load[shard]++
+	}
+
+	var unassigned []string
+	for market := range all {
+		if _, ok := s.assigned[market]; !ok {
+			unassigned = append(unassigned, market)
+		}
+	}
+	sort.Strings(unassigned)
+
+	for _, market := range unassigned {
+		shard := -1
+		for i, n := range load {
+			if (s.ShardSize <= 0 || n < s.ShardSize) && (shard < 0 || n < load[shard]) {
+				shard = i
+			}
+		}
+		if shard < 0 {
+			s.addShard()
+			load = append(load, 0)
+			shard = len(load) - 1
+		}
+		s.assigned[market] = shard
+		load[shard]++
+	}
+}
+
+// Markets returns the current subscription of every data type across all shards.
+func (s *Stream) Markets() []exchange.Subscription {
+	byType := make(map[string][]string)
+	for _, cm := range s.Shards() {
+		for _, sub := range cm.Markets() {
+			byType[sub.DataType] = append(byType[sub.DataType], sub.Markets...)
+		}
+	}
+
+	subs := make([]exchange.Subscription, 0, len(s.DataTypes))
+	for _, dataType := range s.DataTypes {
+		markets := byType[dataType]
+		sort.Strings(markets)
+		subs = append(subs, exchange.Subscription{DataType: dataType, Markets: markets})
+	}
+	return subs
+}
+
+// CheckMarkets checks that markets can be added to the stream: one of its data
+// types takes markets and the platform lists them, when it tells which markets
+// it lists. Without markets it only checks the former, as for RemoveMarkets.
+func (s *Stream) CheckMarkets(ctx context.Context, markets []string) error {
+	takes := false
+	for _, dataType := range s.DataTypes {
+		listed, err := s.ex.Markets(ctx, dataType)
+		if err != nil {
+			return fmt.Errorf("failed to load %s %s markets: %v", s.Platform, dataType, err)
+		}
+		takes = takes || listed != nil
+	}
+	if !takes {
+		return fmt.Errorf("%w: %s %s", ErrNoMarkets, s.Platform, s.DataType())
+	}
+
+	lister, ok := s.ex.(exchange.Lister)
+	if !ok || len(markets) == 0 {
+		return nil
+	}
+	unlisted, err := lister.Unlisted(ctx, markets)
+	if err != nil {
+		return fmt.Errorf("failed to load %s markets: %v", s.Platform, err)
+	}
+	if len(unlisted) > 0 {
+		return fmt.Errorf("%w on %s: %s", ErrUnlisted, s.Platform, strings.Join(unlisted, ", "))
+	}
+	return nil
+}
+
+// AddMarkets subscribes the running stream to additional markets on the live sockets.
+func (s *Stream) AddMarkets(markets []string) {
+	s.mu.Lock()
+	for _, market := range markets {
+		delete(s.excluded, market)
+		s.extra[market] = true
+	}
+	s.mu.Unlock()
+	s.resync()
+}
+
+// RemoveMarkets unsubscribes the running stream from markets on the live sockets.
+// Removed markets stay excluded even if the exchange keeps listing them.
+func (s *Stream) RemoveMarkets(markets []string) {
+	s.mu.Lock()
+	for _, market := range markets {
+		delete(s.extra, market)
+		s.excluded[market] = true
+	}
+	s.mu.Unlock()
+	s.resync()
+}
+
+// Overrides returns the markets added through AddMarkets and removed through
+// RemoveMarkets, sorted.
+func (s *Stream) Overrides() (extra, excluded []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for market := range s.extra {
+		extra = append(extra, market)
+	}
+	for market := range s.excluded {
+		excluded = append(excluded, market)
+	}
+	sort.Strings(extra)
+	sort.Strings(excluded)
+	return extra, excluded
+}
+
+func (s *Stream) resync() {
+	for _, cm := range s.Shards() {
+		cm.requestResync()
+	}
+}
+
+// Shards returns the connection managers of the stream.
+func (s *Stream) Shards() []*ConnectionManager {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*ConnectionManager(nil), s.shards...)
+}
+
+// Health reports the state of every shard and exports it as metrics.
+func (s *Stream) Health() []ShardHealth {
+	shards := s.Shards()
+	health := make([]ShardHealth, 0, len(shards))
+	for _, cm := range shards {
+		h := ShardHealth{
+			Shard:       cm.Shard,
+			StateInfo:   cm.State(),
+			Connected:   cm.Connected(),
+			Stale:       cm.Stale(),
+			LastMessage: cm.LastMessage(),
+		}
+		h.Supervisor, _ = s.sup.Status(cm.Target())
+		for _, sub := range cm.Markets() {
+			h.Markets += len(sub.Markets)
+		}
+		health = append(health, h)
+	}
+	return health
+}
+
+// StreamStatus reports a stream and the state of its connections.
+type StreamStatus struct {
+	Platform  string    `json:"platform"`
+	DataType  string    `json:"dataType"`
+	StartedBy string    `json:"startedBy,omitempty"`
+	StartedAt time.Time `json:"startedAt"`
+	// Up is true when every shard is streaming.
+	Up     bool          `json:"up"`
+	Shards []ShardHealth `json:"shards"`
+	// Queued is the number of messages waiting for a publisher worker.
+	Queued int `json:"queued"`
+}
+
+// Status reports the stream and the state of every shard.
+func (s *Stream) Status() StreamStatus {
+	status := StreamStatus{
+		Platform:  s.Platform,
+		DataType:  s.DataType(),
+		StartedBy: s.StartedBy,
+		StartedAt: s.StartedAt,
+		Shards:    s.Health(),
+	}
+	s.mu.Lock()
+	pipeline := s.pipeline
+	s.mu.Unlock()
+	if pipeline != nil {
+		status.Queued = pipeline.Depth()
+	}
+	status.Up = len(status.Shards) > 0
+	for _, h := range status.Shards {
+		if h.State != StateStreaming {
+			status.Up = false
+		}
+	}
+	return status
+}
+
+// Stop waits for the connections of a cancelled stream to return, hands the
+// queued messages to the producer and clears the shard metrics. It gives up
+// once ctx is done.
+func (s *Stream) Stop(ctx context.Context) error {
+	for _, cm := range s.Shards() {
+		cm.setState(StateStopping, nil)
+	}
+	shardMetrics.release(s.Platform, s.DataType(), s, s.deleteShardMetrics)
+	s.mu.Lock()
+	pipeline := s.pipeline
+	exited := s.exited
+	s.mu.Unlock()
+
+	// The managers push what they read until they return, so the pipeline is
+	// only closed after them.
+	for _, done := range exited {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return fmt.Errorf("connections of %s %s did not stop: %w", s.Platform, s.DataType(), ctx.Err())
+		}
+	}
+	if pipeline != nil {
+		return pipeline.Close(ctx)
+	}
+	return nil
+}
+
+func (s *Stream) deleteShardMetrics() {
+	labels := prometheus.Labels{"platform": s.Platform, "data_type": s.DataType()}
+	metrics.ShardConnected.DeletePartialMatch(labels)
+	metrics.ShardStale.DeletePartialMatch(labels)
+}
+
+// MarketEvents returns a listener that announces the listings and delistings of
+// a platform on the market events queue. It is meant for the platform's market
+// catalog, so that every change is announced once however many streams follow it.
+func MarketEvents(rp *rabbitmq.Producer, platform string) func(listed, delisted []string) {
+	return func(listed, delisted []string) {
+		for _, market := range listed {
+			publishMarketEvent(rp, "market_listed", platform, market)
+		}
+		for _, market := range delisted {
+			publishMarketEvent(rp, "market_delisted", platform, market)
+		}
+	}
+}
+
+func publishMarketEvent(rp *rabbitmq.Producer, eventType, platform, market string) {
+	log.Logger.Info(fmt.Sprintf("%s %s on %s", eventType, market, platform))
+	if rp == nil {
+		log.Logger.Error("Producer is nil")
+		return
+	}
+	body, err := json.Marshal(marketEvent{
+		Type:     eventType,
+		Platform: platform,
+		Market:   market,
+		Time:     time.Now().UTC(),
+	})
+	if err != nil {
+		log.Logger.Error("Failed to encode market event", zap.Error(err))
+		return
+	}
+	if err := rp.SendMessage(marketEventsQueue, string(body)); err != nil {
+		log.Logger.Error("Failed to send message to queue "+marketEventsQueue, zap.Error(err))
+	}
+}
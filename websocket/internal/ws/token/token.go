@@ -1,14 +1,13 @@
 package token
 
 import (
+	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/google/uuid"
-	"go.uber.org/zap"
-	"log"
 	"upbit/internal/domain"
 )
 
-func CreateToken(token domain.Token) string {
+func CreateToken(token domain.Token) (string, error) {
 	tkn := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"access_key": token.AccessKey,
 		"nonce":      uuid.New().String(),
@@ -16,7 +15,7 @@ func CreateToken(token domain.Token) string {
 
 	jwtToken, err := tkn.SignedString([]byte(token.SecretKey))
 	if err != nil {
-		log.Fatalf("Error caused by Token Creation process", zap.Error(err))
+		return "", fmt.Errorf("failed to sign token: %v", err)
 	}
-	return jwtToken
+	return jwtToken, nil
 }